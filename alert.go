@@ -2,18 +2,13 @@ package main
 
 import (
 	"crypto/sha1"
-	"crypto/tls"
-	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
-	"net/mail"
-	"net/smtp"
 	"regexp"
-	"strconv"
-	"strings"
+	"text/template"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -32,8 +27,52 @@ type alert struct {
 	PreviousStatus string
 	fetcher        fetcher
 	EmailTo        string
+	EmailCc        string
+	EmailBcc       string
 	Value          float64
 	RunBookLink    string
+	Evaluator      string
+	BaselineWindow string
+	Baseline       float64
+	Deviation      float64
+	Children       []*alert
+	// set once it's linked to its children, so it stays a composite
+	// even if they all go away
+	composite     bool
+	Operator      string
+	K             int
+	Muted         bool
+	Parents       []*alert
+	IncidentStart time.Time
+	// how many alert emails have gone out since IncidentStart
+	incidentMessages int
+	CheckInterval    time.Duration
+	Window           string
+	NextCheck        time.Time
+	// per-alert notification templates, nil to use the global ones
+	templates *template.Template
+	// set when a failure went unannounced because a parent was down,
+	// so that its recovery doesn't get announced either
+	suppressedIncident bool
+	// since the last status report, how many times it started failing
+	// and how long it spent failed
+	Fired          int
+	FailingFor     time.Duration
+	historyChecked time.Time
+	// who it notified through on-call schedules, most recent last
+	Pages []pageRecord
+	// nil unless it escalates when nobody acknowledges it
+	Escalation *escalationPolicy
+	// nil if it can notify at any time
+	NotifyWindow *notificationWindow
+	// never changed once the alert is set up, so snapshots can share it
+	Labels map[string]string
+	// the alert template it was expanded from, if any
+	ExpandedFrom string
+	// the config file it's defined in
+	Source string
+	// how each series did, when the metric matches more than one
+	Series []seriesStatus
 }
 
 var graphWidth = 800
@@ -52,8 +91,8 @@ func newAlert(name string, metric string, atype string, threshold float64,
 	}
 	return &alert{Name: name, Type: atype,
 		Metric: cleanMetric(metric), Threshold: threshold, Direction: direction,
-		Backoff: 0, LastAlerted: time.Now(), Status: "OK", Message: "",
-		PreviousStatus: "OK", fetcher: fetcher, EmailTo: emailTo,
+		Backoff: 0, LastAlerted: time.Now(), Status: "Pending", Message: "",
+		PreviousStatus: "Pending", fetcher: fetcher, EmailTo: emailTo,
 		Value: 0.0, RunBookLink: runbookLink,
 	}
 }
@@ -64,15 +103,38 @@ func cleanMetric(metric string) string {
 }
 
 func (a alert) URL() string {
-	return graphiteBase + "?target=keepLastValue(" + a.Metric + ")&format=raw&from=-" + window
+	return graphiteBase + "?target=keepLastValue(" + a.Metric + ")&format=raw&from=-" + a.window()
+}
+
+func (a alert) window() string {
+	if a.Window != "" {
+		return a.Window
+	}
+	return window
+}
+
+// SeriesURL fetches every datapoint in the baseline window rather than
+// just the most recent value.
+func (a alert) SeriesURL() string {
+	w := a.BaselineWindow
+	if w == "" {
+		w = a.window()
+	}
+	return graphiteBase + "?target=" + a.Metric + "&format=raw&from=-" + w
+}
+
+// WeeklyBaselineURL fetches the value the metric had at the same time
+// one week ago.
+func (a alert) WeeklyBaselineURL() string {
+	return graphiteBase + "?target=keepLastValue(timeShift(" + a.Metric + ",'7d'))&format=raw&from=-" + a.window()
 }
 
 func (a alert) DailyGraphURL() string {
 	return graphiteBase + "?target=" +
 		a.Metric + "&target=threshold(" +
 		fmt.Sprintf("%f", a.Threshold) +
-		")&width=" + fmt.Sprintf("%d", graphWidth * 2) +
-		"&height=" + fmt.Sprintf("%d", dailyGraphHeight * 2) +
+		")&width=" + fmt.Sprintf("%d", graphWidth*2) +
+		"&height=" + fmt.Sprintf("%d", dailyGraphHeight*2) +
 		"&fontSize=20" +
 		"&bgcolor=" + dailyBgColor +
 		"&fgcolor=" + fgColor + "&hideGrid=true&colorList=" +
@@ -83,8 +145,8 @@ func (a alert) WeeklyGraphURL() string {
 	return graphiteBase + "?target=" +
 		a.Metric + "&target=threshold(" +
 		fmt.Sprintf("%f", a.Threshold) +
-		")&width=" + fmt.Sprintf("%d", graphWidth * 2) +
-		"&height=" + fmt.Sprintf("%d", weeklyGraphHeight * 2) +
+		")&width=" + fmt.Sprintf("%d", graphWidth*2) +
+		"&height=" + fmt.Sprintf("%d", weeklyGraphHeight*2) +
 		"&fontSize=20" +
 		"&hideGrid=true&hideLegend=true&graphOnly=true&hideAxes=true&bgcolor=" +
 		weeklyBgColor + "&fgcolor=" + fgColor +
@@ -95,7 +157,14 @@ type fetcher interface {
 	Get(string) (*http.Response, error)
 }
 
-type httpFetcher struct{}
+type httpFetcher struct {
+	// auth is used instead of the current graphite credentials, if set
+	auth *basicAuth
+}
+
+type basicAuth struct {
+	user, password string
+}
 
 func (h httpFetcher) Get(url string) (*http.Response, error) {
 	client := http.Client{Timeout: time.Second * 10}
@@ -106,54 +175,67 @@ func (h httpFetcher) Get(url string) (*http.Response, error) {
 		log.WithFields(log.Fields{
 			"error": fmt.Sprintf("%v", err),
 		}).Error("error creating request object to graphite")
+		return nil, err
 	}
 
 	// If basic auth username and password are configured, use them.
-	if graphiteBasicAuthUser != "" && graphiteBasicAuthPassword != "" {
-		req.SetBasicAuth(graphiteBasicAuthUser, graphiteBasicAuthPassword)
+	// Graphs are fetched by the outbox, which carries on through a
+	// reload, so the credentials are read under settingsMu.
+	settingsMu.RLock()
+	user, password := graphiteBasicAuthUser, graphiteBasicAuthPassword
+	settingsMu.RUnlock()
+	if h.auth != nil {
+		user, password = h.auth.user, h.auth.password
+	}
+	if user != "" && password != "" {
+		req.SetBasicAuth(user, password)
 	}
 
 	return client.Do(req)
 }
 
-func (a *alert) Fetch() (float64, error) {
-	resp, err := a.fetcher.Get(a.URL())
+func (a *alert) fetchBody(url string) (string, error) {
+	resp, err := a.fetcher.Get(url)
 	if err != nil {
 		a.Status = "Error"
 		a.Message = "graphite request failed"
-		return 0.0, errors.New("graphite request failed")
+		return "", errors.New("graphite request failed")
 	}
 	if resp.Status != "200 OK" {
 		a.Status = "Error"
 		a.Message = "graphite did not return 200 OK"
-		return 0.0, errors.New("graphite did not return 200 OK")
+		return "", errors.New("graphite did not return 200 OK")
 	}
 	b, _ := ioutil.ReadAll(resp.Body)
-	s := fmt.Sprintf("%s", b)
-	lv, err := extractLastValue(s)
-	if err != nil {
-		a.Status = "Error"
-		a.Message = err.Error()
-	}
 
 	// Close the response
 	resp.Body.Close()
 
-	return lv, err
+	return fmt.Sprintf("%s", b), nil
 }
 
 func (a *alert) CheckMetric() bool {
-	lv, err := a.Fetch()
+	readings, err := a.fetchReadings()
 	if err != nil {
 		return false
 	}
-	a.UpdateStatus(lv)
+	a.updateFromReadings(readings)
 	return a.Status == "OK"
-
 }
 
 func (a *alert) UpdateStatus(lv float64) {
 	a.Value = lv
+	switch a.Evaluator {
+	case "change":
+		a.updateChangeStatus(lv, "at the start of the window")
+		return
+	case "weekly":
+		a.updateChangeStatus(lv, "at the same time last week")
+		return
+	case "stddev":
+		a.updateDeviationStatus(lv)
+		return
+	}
 	if a.Direction == "above" {
 		// pass if metric is below the threshold
 		if lv < a.Threshold {
@@ -176,14 +258,14 @@ func (a *alert) UpdateStatus(lv float64) {
 }
 
 func (a alert) String() string {
-	if a.Status == "OK" {
+	if a.Status == "OK" || a.Status == "Pending" {
 		return fmt.Sprintf("%s\t%s [%s]", a.Status, a.Name, a.Metric)
 	}
 	return fmt.Sprintf("%s\t%s [%s]: %s (%s)", a.Status, a.Name, a.Metric, a.Message, a.LastAlerted)
 }
 
 func (a alert) RenderDirection() string {
-	if a.Status == "OK" {
+	if !a.down() {
 		if a.Direction == "above" {
 			return "<"
 		}
@@ -200,6 +282,9 @@ func (a alert) BootstrapStatus() string {
 	if a.Status == "OK" {
 		return "OK"
 	}
+	if a.Status == "Pending" {
+		return "Pending"
+	}
 	if a.Status == "Failed" {
 		return "danger"
 	}
@@ -220,18 +305,28 @@ func (a *alert) SendRecoveryMessage() {
 			"name": a.Name,
 		},
 	).Debug("sending Recovery Message")
-	simpleSendMail(emailFrom,
-		a.EmailTo,
-		a.RecoveryEmailSubject(),
-		a.RecoveryEmailBody())
+	now := time.Now()
+	held, sendAt := a.holdNotification("recovery", now)
+	if held {
+		return
+	}
+	if digest != nil {
+		a.addToDigest("recovery")
+		return
+	}
+	m, _ := a.notificationRecipients(now)
+	m.Subject = a.RecoveryEmailSubject()
+	m.Text = a.RecoveryEmailBody()
+	a.threadRecovery(&m)
+	queueMailAt(m, sendAt)
 }
 
 func (a *alert) RecoveryEmailSubject() string {
-	return fmt.Sprintf("[RECOVERED] %s", a.Name)
+	return a.render("recovery_subject")
 }
 
 func (a *alert) RecoveryEmailBody() string {
-	return fmt.Sprintf("%s [%s] has returned %s %f", a.Name, a.Metric, invertDirection(a.Direction), a.Threshold)
+	return a.render("recovery_body")
 }
 
 func invertDirection(d string) string {
@@ -256,17 +351,25 @@ func (a *alert) SendAlert() {
 			"name": a.Name,
 		},
 	).Debug("Sending Alert")
-	simpleSendMail(emailFrom,
-		a.EmailTo,
-		a.alertEmailSubject(),
-		a.alertEmailBody())
+	now := time.Now()
+	held, sendAt := a.holdNotification("alert", now)
+	if held {
+		return
+	}
+	if digest != nil {
+		a.addToDigest("alert")
+		return
+	}
+	m := a.alertEmailMessage()
+	recipients, pages := a.notificationRecipients(now)
+	m.To, m.Cc, m.Bcc = recipients.To, recipients.Cc, recipients.Bcc
+	a.recordPages(pages)
+	a.threadAlert(&m)
+	queueMailAt(m, sendAt)
 }
 
 func (a *alert) alertEmailSubject() string {
-	if a.Type == "Alert" {
-		return fmt.Sprintf("[ALERT] %s", a.Name)
-	}
-	return fmt.Sprintf("[NOTICE] %s", a.Name)
+	return a.render("alert_subject")
 }
 
 func (a *alert) IncludeRunBookLink() string {
@@ -277,18 +380,19 @@ func (a *alert) IncludeRunBookLink() string {
 }
 
 func (a *alert) alertEmailBody() string {
-	return fmt.Sprintf("%s [%s] has triggered an alert\nStatus:\t%s\nMessage:\t%s\n\nDaily Graph: <%s>\nWeekly Graph: <%s>%s\n",
-		a.Name, a.Metric, a.Status, a.Message, a.DailyGraphURL(), a.WeeklyGraphURL(), a.IncludeRunBookLink())
+	return a.render("alert_body")
 }
 
 // did this alert just return to a healthy state?
-// returns 1 if just recovered, 0 otherwise
+// returns 1 if just recovered, 0 otherwise. Coming out of "Pending" on
+// the first check after startup doesn't count.
 func (a *alert) JustRecovered() bool {
 	return a.PreviousStatus == "Failed" || a.PreviousStatus == "Error"
 }
 
 func (a *alert) SendRecoveryMessageIfNeeded(recoveriesSent int) {
-	if a.JustRecovered() && recoveriesSent < globalThrottle {
+	// a digest lists every recovery, so there's nothing to throttle
+	if a.JustRecovered() && (recoveriesSent < globalThrottle || digest != nil) && !a.Muted {
 		a.SendRecoveryMessage()
 	}
 }
@@ -298,14 +402,42 @@ func (a *alert) UpdateState(recoveriesSent int) (int, int, int, int, int) {
 	errors := 0
 	failures := 0
 	alertsSent := 0
+	if a.Status == "Pending" {
+		// not checked yet (or a composite waiting on its children), so
+		// there's nothing to say about it and nothing to back off from
+		return successes, recoveriesSent, errors, failures, alertsSent
+	}
+	a.startIncidentIfNeeded(time.Now())
 
 	if a.Status == "OK" {
 		successes++
-		a.SendRecoveryMessageIfNeeded(recoveriesSent)
-		if a.JustRecovered() {
-			recoveriesSent++
+		a.resolveIncident()
+		if a.suppressedIncident {
+			a.suppressedIncident = false
+		} else {
+			a.SendRecoveryMessageIfNeeded(recoveriesSent)
+			if a.JustRecovered() && !a.Muted {
+				recoveriesSent++
+			}
 		}
 		a.Backoff = 0
+	} else if a.Suppressed() {
+		if a.Status == "Error" {
+			errors++
+		} else {
+			failures++
+		}
+		if !a.JustRecovered() {
+			// only stay quiet about the recovery if we never said
+			// anything about the failure
+			a.suppressedIncident = true
+		}
+		log.WithFields(
+			log.Fields{
+				"name":       a.Name,
+				"root_cause": a.RootCause().Name,
+			},
+		).Debug("suppressed by dependency")
 	} else {
 		// this one is broken. if we're not in a backoff period
 		// we need to send a message
@@ -321,14 +453,21 @@ func (a *alert) UpdateState(recoveriesSent int) (int, int, int, int, int) {
 					"recoveriesSent": recoveriesSent,
 				},
 			).Debug("throttled")
+		} else if a.Acknowledged() {
+			// somebody's on it; stay quiet until it recovers
+			log.WithFields(log.Fields{"name": a.Name}).Debug("acknowledged")
 		} else {
-			if a.Status == "Failed" && alertsSent < globalThrottle {
+			if a.Status == "Failed" && alertsSent < globalThrottle && !a.Muted {
 				a.SendAlert()
 				alertsSent++
+				a.suppressedIncident = false
 			}
 			a.Backoff = intmin(a.Backoff+1, len(backoffDurations))
 			a.LastAlerted = time.Now()
 		}
+		if a.Status == "Failed" && !a.Muted {
+			a.escalateIfNeeded(time.Now())
+		}
 	}
 	// cycle the previous status
 	a.PreviousStatus = a.Status
@@ -341,119 +480,16 @@ func (a alert) Hash() string {
 	io.WriteString(h, fmt.Sprintf("direction: %s", a.Direction))
 	io.WriteString(h, fmt.Sprintf("threshold: %f", a.Threshold))
 	io.WriteString(h, fmt.Sprintf("type: %s", a.Type))
-	return fmt.Sprintf("%x", h.Sum(nil))[0:10]
-}
-
-func extractLastValue(rawResponse string) (float64, error) {
-	// just take the most recent value
-	parts := strings.Split(strings.Trim(rawResponse, "\n\t "), ",")
-	return strconv.ParseFloat(parts[len(parts)-1], 64)
-}
-
-func simpleSendMail(from, to, subject string, body string) error {
-	log.WithFields(
-		log.Fields{
-			"From":    from,
-			"To":      to,
-			"Subject": subject,
-		},
-	).Debug("simpleSendMail")
-	header := make(map[string]string)
-	header["From"] = from
-	header["To"] = to
-	header["Subject"] = subject
-	header["MIME-Version"] = "1.0"
-	header["Content-Type"] = "text/plain; charset=\"utf-8\""
-	header["Content-Transfer-Encoding"] = "base64"
-
-	message := ""
-	for k, v := range header {
-		message += fmt.Sprintf("%s: %s\r\n", k, v)
+	if a.Evaluator != "" {
+		io.WriteString(h, fmt.Sprintf("evaluator: %s", a.Evaluator))
 	}
-	message += "\r\n" + base64.StdEncoding.EncodeToString([]byte(body))
-	s := fmt.Sprintf("%s:%d", smtpServer, smtpPort)
-	auth := smtp.PlainAuth("", smtpUser, smtpPassword, smtpServer)
-
-	if smtpPort == 25 {
-		err := smtp.SendMail(s, auth, from, []string{to}, []byte(message))
-		if err != nil {
-			log.WithFields(
-				log.Fields{
-					"error":       err,
-					"mail server": s,
-				},
-			).Error("error sending mail")
+	if a.IsComposite() {
+		io.WriteString(h, fmt.Sprintf("operator: %s %d", a.Operator, a.K))
+		for _, c := range a.Children {
+			io.WriteString(h, fmt.Sprintf("child: %s", c.Name))
 		}
-		return err
 	}
-	tlsconfig := &tls.Config{
-		InsecureSkipVerify: true,
-		ServerName:         smtpServer,
-	}
-
-	conn, err := tls.Dial("tcp", s, tlsconfig)
-	if err != nil {
-		log.WithFields(log.Fields{"err": err}).Error("tls.Dial failed")
-		return err
-	}
-
-	c, err := smtp.NewClient(conn, smtpServer)
-	if err != nil {
-		log.WithFields(log.Fields{"err": err}).Error("smtp.NewClient failed")
-		return err
-	}
-
-	// Auth
-	if err = c.Auth(auth); err != nil {
-		log.WithFields(
-			log.Fields{
-				"err":           err,
-				"SMTP_USER":     smtpUser,
-				"SMTP_PASSWORD": smtpPassword,
-				"SMTP_SERVER":   smtpServer,
-			}).Error("auth failed")
-		return err
-	}
-
-	// To && From
-	if err = c.Mail(from); err != nil {
-		log.WithFields(log.Fields{"err": err, "from": from}).Error("from address failed")
-		return err
-	}
-
-	if err = c.Rcpt(to); err != nil {
-		log.WithFields(log.Fields{"err": err}).Error("to address failed")
-		return err
-	}
-
-	// Data
-	w, err := c.Data()
-	if err != nil {
-		log.WithFields(log.Fields{"err": err}).Error("smtp Data() failed")
-		return err
-	}
-
-	_, err = w.Write([]byte(message))
-	if err != nil {
-		log.WithFields(log.Fields{"err": err}).Error("smtp Write failed")
-		return err
-	}
-
-	err = w.Close()
-	if err != nil {
-		log.WithFields(log.Fields{"err": err}).Error("smtp close failed")
-		return err
-	}
-
-	c.Quit()
-	return err
-
-}
-
-func encodeRFC2047(String string) string {
-	// use mail's rfc2047 to encode any string
-	addr := mail.Address{Name: String, Address: ""}
-	return strings.Trim(addr.String(), " <>")
+	return fmt.Sprintf("%x", h.Sum(nil))[0:10]
 }
 
 var backoffDurations = []time.Duration{
@@ -13,6 +13,10 @@ func (d DummyFetcher) Get(url string) (*http.Response, error) { return nil, nil
 
 func Test_String(t *testing.T) {
 	a := newAlert("foo", "foo", "", 10, "above", DummyFetcher{}, "test@example.com", "")
+	if a.String() != "Pending\tfoo [foo]" {
+		t.Error("wrong value")
+	}
+	a.Status = "OK"
 	if a.String() != "OK\tfoo [foo]" {
 		t.Error("wrong value")
 	}
@@ -100,6 +104,7 @@ func Test_RecoveryEmailBody(t *testing.T) {
 
 func Test_UpdateState(t *testing.T) {
 	a := newAlert("foo", "foo", "", 10, "above", DummyFetcher{}, "test@example.com", "")
+	a.Status = "OK"
 	s, rs, e, f, as := a.UpdateState(0)
 	if s != 1 {
 		t.Error("s is wrong")
@@ -154,22 +159,24 @@ func Test_UpdateState(t *testing.T) {
 
 }
 
-func Test_extractLastValue(t *testing.T) {
-	v, err := extractLastValue("1,2")
+func Test_lastValue(t *testing.T) {
+	series, err := parseSeries("1,2")
 	if err != nil {
 		t.Error("returned an error")
 	}
-	if v != 2.0 {
+	v, err := series[0].last()
+	if err != nil || v != 2.0 {
 		t.Error("wrong value parsed")
 	}
-	v, err = extractLastValue("None")
+	series, _ = parseSeries("None")
+	v, err = series[0].last()
 	if err == nil {
 		t.Error("should've returned an error")
 	}
 	if v != 0.0 {
 		t.Error("should return 0")
 	}
-	_, err = extractLastValue("")
+	_, err = parseSeries("")
 	if err == nil {
 		t.Error("expected an error")
 	}
@@ -222,6 +229,10 @@ func Test_RenderDirection(t *testing.T) {
 
 func Test_BootstrapStatus(t *testing.T) {
 	a := newAlert("foo", "foo", "", 10, "above", DummyFetcher{}, "test@example.com", "")
+	if a.BootstrapStatus() != "Pending" {
+		t.Error("bootstrap status Pending expected Pending")
+	}
+	a.Status = "OK"
 	if a.BootstrapStatus() != "OK" {
 		t.Error("bootstrap status OK expected OK")
 	}
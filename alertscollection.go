@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"math"
 	"net"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -15,66 +16,194 @@ type pageResponse struct {
 	GraphiteBase string
 	MetricBase   string
 	Alerts       []*alert
+	RootCauses   []rootCauseGroup
+	Queued       int
+	DeadLetters  []queuedNotification
+	OnCall       []pageRecord
+	Filters      []labelMatcher
 }
 
 type indivPageResponse struct {
 	GraphiteBase string
 	MetricBase   string
 	Alert        *alert
+	// AckToken is set when the page was opened from a notification's
+	// link to acknowledge the alert
+	AckToken string
 }
 
 type alertsCollection struct {
 	alerts       []*alert
 	alertsByHash map[string]*alert
+	alertsByName map[string]*alert
 	emailer      emailer
+
+	mu       sync.RWMutex
+	snapshot alertsSnapshot
+
+	// on-call schedules as of when the collection was set up, put into
+	// effect when it starts
+	schedules map[string]*onCallSchedule
+	windows   []*notificationWindow
+
+	// the period the next status report covers
+	lastReport time.Time
+	nextReport time.Time
+	// the schedule nextReport was worked out from
+	reportSchedule reportSchedule
+
+	// what each alert was built from, to tell what a reload changed
+	definitions map[string]alertData
+
+	// alert templates, expanded again every expandInterval
+	builder        *alertBuilder
+	expansions     []*alertExpansion
+	finder         graphiteFinder
+	expandInterval time.Duration
+	nextExpand     time.Time
 }
 
 func newAlertsCollection(e emailer) *alertsCollection {
-	return &alertsCollection{emailer: e, alertsByHash: make(map[string]*alert)}
+	return &alertsCollection{emailer: e, alertsByHash: make(map[string]*alert),
+		alertsByName: make(map[string]*alert), definitions: make(map[string]alertData),
+		finder:         graphiteFinder{fetcher: httpFetcher{}},
+		expandInterval: defaultExpandInterval}
 }
 
 func (ac *alertsCollection) addAlert(a *alert) {
 	ac.alerts = append(ac.alerts, a)
 	ac.alertsByHash[a.Hash()] = a
+	ac.alertsByName[a.Name] = a
 }
 
 func (ac *alertsCollection) byHash(s string) *alert {
 	return ac.alertsByHash[s]
 }
 
-func (ac *alertsCollection) checkAll() {
+// removeAlert takes a out of the collection, and out of any composite
+// or dependency that refers to it.
+func (ac *alertsCollection) removeAlert(a *alert) {
+	for i, o := range ac.alerts {
+		if o == a {
+			ac.alerts = append(ac.alerts[:i], ac.alerts[i+1:]...)
+			break
+		}
+	}
+	if ac.alertsByHash[a.Hash()] == a {
+		delete(ac.alertsByHash, a.Hash())
+	}
+	if ac.alertsByName[a.Name] == a {
+		delete(ac.alertsByName, a.Name)
+	}
+	for _, o := range ac.alerts {
+		if children := withoutAlert(o.Children, a); len(children) != len(o.Children) {
+			// the hash covers the children, so re-register under the new one
+			delete(ac.alertsByHash, o.Hash())
+			o.Children = children
+			ac.alertsByHash[o.Hash()] = o
+		}
+		o.Parents = withoutAlert(o.Parents, a)
+	}
+}
+
+// replaceAlert puts a in old's place, in the collection and in any
+// composite or dependency that refers to old.
+func (ac *alertsCollection) replaceAlert(old, a *alert) {
+	for i, o := range ac.alerts {
+		if o == old {
+			ac.alerts[i] = a
+			break
+		}
+	}
+	if ac.alertsByHash[old.Hash()] == old {
+		delete(ac.alertsByHash, old.Hash())
+	}
+	ac.alertsByHash[a.Hash()] = a
+	ac.alertsByName[a.Name] = a
+	a.Muted = old.Muted
+	for _, o := range ac.alerts {
+		o.Children = replacedAlert(o.Children, old, a)
+		o.Parents = replacedAlert(o.Parents, old, a)
+	}
+}
+
+func replacedAlert(alerts []*alert, old, a *alert) []*alert {
+	for i, o := range alerts {
+		if o == old {
+			replaced := append([]*alert(nil), alerts...)
+			replaced[i] = a
+			return replaced
+		}
+	}
+	return alerts
+}
+
+func withoutAlert(alerts []*alert, a *alert) []*alert {
+	for i, o := range alerts {
+		if o == a {
+			return append(alerts[:i:i], alerts[i+1:]...)
+		}
+	}
+	return alerts
+}
+
+func (ac *alertsCollection) byName(s string) *alert {
+	return ac.alertsByName[s]
+}
+
+// tally counts the current status of every alert, whether or not it
+// was checked this cycle.
+func (ac *alertsCollection) tally() (int, int, int) {
+	successes := 0
+	errors := 0
+	failures := 0
 	for _, a := range ac.alerts {
-		a.CheckMetric()
+		switch a.Status {
+		case "OK":
+			successes++
+		case "Error":
+			errors++
+		case "Failed":
+			failures++
+		}
 	}
+	return successes, errors, failures
 }
 
 func (ac *alertsCollection) processAll() {
-	// fetch/calculate new status for all
-	ac.checkAll()
+	// fetch/calculate new status for the ones that are due
+	now := time.Now()
+	due := ac.checkDue(now)
 	alertsSent := 0
 	recoveriesSent := 0
-	errors := 0
-	failures := 0
-	successes := 0
 
-	for _, a := range ac.alerts {
-		s, rs, e, f, as := a.UpdateState(recoveriesSent)
-		successes = successes + s
-		recoveriesSent = recoveriesSent + rs
-		errors = errors + e
-		failures = failures + f
+	for _, a := range due {
+		a.recordHistory(now)
+		_, rs, _, _, as := a.UpdateState(recoveriesSent)
+		recoveriesSent = rs
 		alertsSent = alertsSent + as
 	}
-	if alertsSent >= globalThrottle {
-		ac.emailer.Throttled(failures, globalThrottle, emailTo)
-	}
+	successes, errors, failures := ac.tally()
+	if digest != nil {
+		// the digests already list everything, however much there is
+		for _, m := range digest.Flush(now) {
+			queueMail(m)
+		}
+	} else {
+		if alertsSent >= globalThrottle {
+			ac.emailer.Throttled(failures, globalThrottle, emailTo)
+		}
 
-	if recoveriesSent >= globalThrottle {
-		ac.emailer.RecoveryThrottled(recoveriesSent, globalThrottle, emailTo)
+		if recoveriesSent >= globalThrottle {
+			ac.emailer.RecoveryThrottled(recoveriesSent, globalThrottle, emailTo)
+		}
 	}
+	flushWindowDigests(ac.windows, now)
 	ac.handleErrors(errors)
+	ac.sendReportIfDue(now)
 	logToGraphite(alertsSent, recoveriesSent, failures, errors, successes)
 	exposeVars(failures, errors, successes)
+	ac.publish()
 }
 
 func exposeVars(failures, errors, successes int) {
@@ -126,11 +255,15 @@ func intmin(a, b int) int {
 }
 
 func (ac *alertsCollection) Run(ctx context.Context) {
+	ac.scheduleInitial(time.Now())
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-time.After(time.Duration(checkInterval) * time.Minute):
+		case <-time.After(ac.untilNextCheck(time.Now())):
+			if now := time.Now(); ac.expandDue(now) {
+				ac.refreshExpansions(now)
+			}
 			ac.processAll()
 			ac.DisplayAll()
 		}
@@ -144,23 +277,41 @@ func (ac *alertsCollection) DisplayAll() {
 }
 
 func roundToFourPlaces(n float64) float64 {
-	return math.Round(n * 10000) / 10000
+	return math.Round(n*10000) / 10000
 }
 
 func (ac *alertsCollection) MakePageResponse() pageResponse {
+	snap := ac.currentSnapshot()
 	pr := pageResponse{GraphiteBase: graphiteBase,
-		MetricBase: metricBase}
-	for _, a := range ac.alerts {
-		// Format floats to four decimal places for display.
-		a.Value = roundToFourPlaces(a.Value)
-
-		pr.Alerts = append(pr.Alerts, a)
+		MetricBase: metricBase,
+		Alerts:     snap.alerts,
+		RootCauses: rootCauseGroups(snap.alerts)}
+	pr.OnCall = onCallNow(ac.schedules, time.Now())
+	if outbox != nil {
+		pr.Queued = outbox.Pending()
+		pr.DeadLetters = outbox.DeadLetters()
 	}
 	return pr
 }
 
-func (ac *alertsCollection) MakeindivPageResponse(idx string) indivPageResponse {
-	return indivPageResponse{GraphiteBase: graphiteBase,
+// filter narrows the page down to the alerts with matching labels.
+func (pr *pageResponse) filter(matchers []labelMatcher) {
+	if len(matchers) == 0 {
+		return
+	}
+	pr.Filters = matchers
+	pr.Alerts = filterAlerts(pr.Alerts, matchers)
+	pr.RootCauses = rootCauseGroups(pr.Alerts)
+}
+
+func (ac *alertsCollection) MakeindivPageResponse(idx, ackToken string) indivPageResponse {
+	pr := indivPageResponse{GraphiteBase: graphiteBase,
 		MetricBase: metricBase,
-		Alert:      ac.byHash(idx)}
+		Alert:      ac.currentSnapshot().byHash[idx]}
+	if pr.Alert != nil && escalations != nil {
+		if r, ok := escalations.lookup(pr.Alert.Name); ok && r.validToken(ackToken) {
+			pr.AckToken = ackToken
+		}
+	}
+	return pr
 }
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"html/template"
+	"strings"
 	"testing"
+	"time"
 )
 
 func Test_intmin(t *testing.T) {
@@ -44,3 +48,45 @@ func Test_addAlert(t *testing.T) {
 		t.Error("failed to retrieve alert")
 	}
 }
+
+// the dashboard only parses its templates when a page is asked for, and
+// a template that won't parse stops hound
+func Test_dashboardTemplates(t *testing.T) {
+	withEscalationTest(t, "")
+	ac := newAlertsCollection(DummyEmailer{})
+	parent := newAlert("parent", "parent", "", 10, "above", DummyFetcher{}, "test@example.com", "")
+	child := newAlert("child", "child", "", 10, "above", DummyFetcher{}, "test@example.com", "")
+	ac.addAlert(parent)
+	ac.addAlert(child)
+	ac.linkDependencies(child, alertData{Name: "child", DependsOn: []string{"parent"}})
+	parent.Status, child.Status = "Failed", "Failed"
+	parent.startIncidentIfNeeded(time.Now())
+	child.startIncidentIfNeeded(time.Now())
+	escalations.acknowledge(parent.Name, parent.ackToken(), "alice", time.Now())
+	ac.publish()
+
+	render := func(file string, data interface{}) string {
+		tmpl, err := template.ParseFiles(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if err := tmpl.Execute(&out, data); err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		return out.String()
+	}
+	if page := render("index.html", ac.MakePageResponse()); !strings.Contains(page, "acknowledged by alice") {
+		t.Error("the dashboard should show the acknowledgement")
+	}
+	if page := render("alert.html", ac.MakeindivPageResponse(parent.Hash(), "")); !strings.Contains(page, "by alice") {
+		t.Error("the alert page should show who acknowledged it")
+	}
+	if page := render("alert.html", ac.MakeindivPageResponse(child.Hash(), "")); strings.Contains(page, "Acknowledge</button>") {
+		t.Error("the alert page shouldn't offer to acknowledge it without the token")
+	}
+	if page := render("alert.html", ac.MakeindivPageResponse(child.Hash(), child.ackToken())); !strings.Contains(page, "Acknowledge</button>") {
+		t.Error("the acknowledge link should offer to acknowledge it")
+	}
+	render("email.html", htmlEmailData{Alert: child})
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"strings"
+)
+
+// `hound check -config path` reads and validates a config without
+// starting anything, so a change can be checked before it's deployed.
+// It exits non-zero if there's anything wrong. With -fetch, it also
+// fetches every metric from Graphite and says what each alert's status
+// would be right now.
+
+// checkProblem is something wrong with the config, or with one alert
+// in it.
+type checkProblem struct {
+	Alert   string
+	Source  string
+	Problem string
+}
+
+func (p checkProblem) String() string {
+	switch {
+	case p.Alert == "":
+		return p.Problem
+	case p.Source == "":
+		return fmt.Sprintf("%q: %s", p.Alert, p.Problem)
+	}
+	return fmt.Sprintf("%s: %q: %s", p.Source, p.Alert, p.Problem)
+}
+
+// runCheck is the check subcommand, returning the exit status.
+func runCheck(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	configfile := fs.String("config", "./config.json", "JSON or YAML config file, directory or glob")
+	fetch := fs.Bool("fetch", false, "fetch every metric from Graphite and show what its status would be")
+	fs.Parse(args)
+
+	problems := checkConfig(*configfile, *fetch, os.Stdout)
+	for _, p := range problems {
+		fmt.Fprintln(os.Stdout, p)
+	}
+	if len(problems) > 0 {
+		if len(problems) == 1 {
+			fmt.Fprintln(os.Stdout, "1 problem")
+		} else {
+			fmt.Fprintf(os.Stdout, "%d problems\n", len(problems))
+		}
+		return 1
+	}
+	fmt.Fprintln(os.Stdout, "config OK")
+	return 0
+}
+
+// checkConfig finds everything wrong with the config at path, writing
+// the status of each alert to out if fetch is set.
+func checkConfig(path string, fetch bool, out io.Writer) []checkProblem {
+	f, err := readConfig(path)
+	if err != nil {
+		return []checkProblem{{Problem: err.Error()}}
+	}
+	var problems []checkProblem
+	c, err := loadSettings(f)
+	if err != nil {
+		return []checkProblem{{Problem: err.Error()}}
+	}
+	apply, err := prepareSettings(c)
+	if err != nil {
+		problems = append(problems, checkProblem{Problem: err.Error()})
+	} else if fetch {
+		apply()
+	}
+
+	if !fetch {
+		// without graphite to ask, try each template on its wildcard
+		f.Alerts = sampleExpansions(f.Alerts, &problems)
+	}
+	for _, d := range f.Alerts {
+		for _, p := range checkAlertData(d) {
+			problems = append(problems, checkProblem{Alert: d.Name, Source: d.Source, Problem: p})
+		}
+	}
+
+	ac, err := buildAlertsCollection(f, c)
+	if err != nil {
+		return append(problems, checkProblem{Problem: err.Error()})
+	}
+	problems = append(problems, checkBuiltAlerts(ac)...)
+	if fetch {
+		problems = append(problems, fetchAlerts(ac, out)...)
+	}
+	return problems
+}
+
+// sampleExpansions replaces each alert template with the alert it
+// makes for its own wildcard.
+func sampleExpansions(alerts []alertData, problems *[]checkProblem) []alertData {
+	var sampled []alertData
+	for _, d := range alerts {
+		if d.Expand == "" {
+			sampled = append(sampled, d)
+			continue
+		}
+		e, err := newAlertExpansion(d)
+		if err != nil {
+			*problems = append(*problems, checkProblem{Alert: d.Name, Source: d.Source, Problem: err.Error()})
+			continue
+		}
+		// newAlertExpansion has already tried this one
+		sample, _ := e.alertData(newExpandMatch(d.Expand, d.Expand))
+		sampled = append(sampled, sample)
+	}
+	return sampled
+}
+
+// checkAlertData finds what's wrong with one alert on its own.
+func checkAlertData(d alertData) []string {
+	var problems []string
+	if d.Name == "" {
+		problems = append(problems, "no Name")
+	}
+	switch d.Type {
+	case "", "Alert", "Notice":
+	default:
+		problems = append(problems, fmt.Sprintf("Type must be \"Alert\" or \"Notice\", not %q", d.Type))
+	}
+	if d.CheckInterval < 0 {
+		problems = append(problems, "CheckInterval can't be negative")
+	}
+	for _, list := range []string{d.EmailTo, d.EmailCc, d.EmailBcc} {
+		problems = append(problems, checkAddresses(list)...)
+	}
+	if len(d.Children) > 0 {
+		// composites are checked as they're linked to their children
+		return problems
+	}
+	if d.Metric == "" {
+		problems = append(problems, "no Metric")
+	}
+	if d.Direction != "above" && d.Direction != "below" {
+		problems = append(problems, fmt.Sprintf("Direction must be \"above\" or \"below\", not %q", d.Direction))
+	}
+	// an unknown evaluator stops the alerts being built
+	switch d.Evaluator {
+	case "change", "weekly", "stddev":
+		if d.Threshold <= 0 {
+			problems = append(problems, fmt.Sprintf("Threshold must be more than 0 for the %q evaluator", d.Evaluator))
+		}
+	}
+	return problems
+}
+
+// checkAddresses finds the addresses in list that can't be mailed.
+// On-call schedules are checked when the alerts are built.
+func checkAddresses(list string) []string {
+	var problems []string
+	for _, part := range strings.Split(list, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" || strings.HasPrefix(part, onCallPrefix) {
+			continue
+		}
+		if _, err := mail.ParseAddress(part); err != nil {
+			problems = append(problems, fmt.Sprintf("bad address %q: %v", part, err))
+		}
+	}
+	return problems
+}
+
+// checkBuiltAlerts finds what's wrong with the alerts once they've been
+// routed and linked up.
+func checkBuiltAlerts(ac *alertsCollection) []checkProblem {
+	var problems []checkProblem
+	seen := make(map[string]*alert)
+	for _, a := range ac.alerts {
+		if a.EmailTo == "" && a.EmailCc == "" && a.EmailBcc == "" {
+			problems = append(problems, checkProblem{Alert: a.Name, Source: a.Source,
+				Problem: "nobody to notify: no EmailTo, no route to a receiver and no global EmailTo"})
+		}
+		h := a.Hash()
+		if other, ok := seen[h]; ok {
+			// alerts are looked up by Hash on the dashboard and when
+			// the config is reloaded, so one would hide the other
+			problems = append(problems, checkProblem{Alert: a.Name, Source: a.Source,
+				Problem: fmt.Sprintf("same Hash (%s) as %q: give them a different metric, threshold, direction, type or evaluator", h, other.Name)})
+			continue
+		}
+		seen[h] = a
+	}
+	return problems
+}
+
+// fetchAlerts checks every alert once, writing what each would be to
+// out. Only a metric that can't be fetched or read is a problem; an
+// alert that's failing right now is working as it should.
+func fetchAlerts(ac *alertsCollection, out io.Writer) []checkProblem {
+	var problems []checkProblem
+	var composites []*alert
+	for _, a := range ac.alerts {
+		if a.IsComposite() {
+			composites = append(composites, a)
+			continue
+		}
+		readings, err := a.fetchReadings()
+		if err != nil {
+			a.Status, a.Message = "Error", err.Error()
+		} else {
+			a.updateFromReadings(readings)
+		}
+		if a.Status == "Error" {
+			problems = append(problems, checkProblem{Alert: a.Name, Source: a.Source,
+				Problem: "can't check metric: " + a.Message})
+		}
+	}
+	// composites can't be nested, so their children are all done
+	for _, a := range composites {
+		a.evaluateComposite()
+	}
+	for _, a := range ac.alerts {
+		line := fmt.Sprintf("%-8s %s", a.Status, a.Name)
+		if !a.IsComposite() && a.Status != "Error" {
+			line += fmt.Sprintf(" = %f", a.Value)
+		}
+		if a.Message != "" {
+			line += ": " + a.Message
+		}
+		fmt.Fprintln(out, line)
+	}
+	return problems
+}
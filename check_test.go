@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func problemText(problems []checkProblem) string {
+	var lines []string
+	for _, p := range problems {
+		lines = append(lines, p.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func Test_checkConfig(t *testing.T) {
+	path := writeConfigFiles(t, map[string]string{"alerts.yaml": `
+Settings:
+  EmailTo: ops@example.com
+Alerts:
+  - Name: disk full
+    Metric: servers.*.disk.used
+    Threshold: 90
+    Direction: above
+  - Name: sideways
+    Metric: servers.*.load
+    Threshold: 5
+    Direction: up
+  - Name: no change
+    Metric: servers.*.requests
+    Direction: below
+    Evaluator: change
+  - Name: bad address
+    Metric: servers.*.errors
+    Threshold: 1
+    Direction: above
+    EmailTo: "not an address"
+  - Name: disk full again
+    Metric: servers.*.disk.used
+    Threshold: 90
+    Direction: above
+  - Name: "{{.Nope}} smoketest"
+    Expand: app.smoketest.*.failed
+    Threshold: 1
+    Direction: above
+`})
+	problems := checkConfig(path, false, &bytes.Buffer{})
+	text := problemText(problems)
+	for _, want := range []string{
+		`"sideways": Direction must be "above" or "below", not "up"`,
+		`"no change": Threshold must be more than 0 for the "change" evaluator`,
+		`"bad address": bad address "not an address"`,
+		`"disk full again": same Hash`,
+		`{{.Nope}} smoketest`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("expected %q in:\n%s", want, text)
+		}
+	}
+	if strings.Contains(text, `alerts.yaml: "disk full":`) {
+		t.Errorf("nothing wrong with the first alert:\n%s", text)
+	}
+	if len(problems) != 5 {
+		t.Errorf("expected 5 problems, got:\n%s", text)
+	}
+	if !strings.HasPrefix(problems[0].String(), path) {
+		t.Errorf("problems should say which file they're in: %s", problems[0])
+	}
+}
+
+func Test_checkConfigOK(t *testing.T) {
+	path := writeConfigFiles(t, map[string]string{"alerts.yaml": `
+Alerts:
+  - Name: "{{.Node 2}} smoketest"
+    Expand: app.smoketest.*.failed
+    Threshold: 1
+    Direction: above
+    EmailTo: "ops@example.com, oncall:ops"
+Schedules:
+  - Name: ops
+    Rotation: [alice@example.com]
+    Start: "2020-01-06T09:00"
+`})
+	if problems := checkConfig(path, false, &bytes.Buffer{}); len(problems) != 0 {
+		t.Errorf("unexpected problems:\n%s", problemText(problems))
+	}
+
+	// unknown on-call schedules and nobody to notify
+	path = writeConfigFiles(t, map[string]string{"alerts.json": `{"Alerts": [
+		{"Name": "a", "Metric": "a", "Threshold": 1, "Direction": "above", "EmailTo": "oncall:nobody"}]}`})
+	if text := problemText(checkConfig(path, false, &bytes.Buffer{})); !strings.Contains(text, "unknown on-call schedule") {
+		t.Errorf("expected an unknown schedule, got:\n%s", text)
+	}
+	path = writeConfigFiles(t, map[string]string{"alerts.json": `{"Alerts": [
+		{"Name": "a", "Metric": "a", "Threshold": 1, "Direction": "above"}]}`})
+	if text := problemText(checkConfig(path, false, &bytes.Buffer{})); !strings.Contains(text, "nobody to notify") {
+		t.Errorf("expected nobody to notify, got:\n%s", text)
+	}
+}
+
+func Test_fetchAlerts(t *testing.T) {
+	ac := buildTestCollection(t,
+		alertData{Name: "ok", Metric: "ok", Threshold: 10, Direction: "above"},
+		alertData{Name: "failing", Metric: "failing", Threshold: 10, Direction: "above"},
+		alertData{Name: "missing", Metric: "missing", Threshold: 10, Direction: "above"},
+		alertData{Name: "either", Children: []string{"ok", "failing"}, Operator: "or"},
+	)
+	f := BodyFetcher{
+		"(ok)":      "ok,1,2,60|3\n",
+		"(failing)": "failing,1,2,60|12\n",
+	}
+	for _, a := range ac.alerts {
+		a.fetcher = f
+	}
+	var out bytes.Buffer
+	problems := fetchAlerts(ac, &out)
+	if len(problems) != 1 || problems[0].Alert != "missing" {
+		t.Errorf("only the missing metric is a problem:\n%s", problemText(problems))
+	}
+	for _, want := range []string{"OK       ok = 3.000000\n", "Failed   failing = 12.000000: ", "Failed   either"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in:\n%s", want, out.String())
+		}
+	}
+}
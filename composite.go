@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+func (a alert) IsComposite() bool {
+	return a.composite || len(a.Children) > 0
+}
+
+// evaluateComposite derives the status of a composite alert from the
+// statuses its children got in this cycle. A child that errored makes
+// the composite an error too, since we can't say what it would have been.
+func (a *alert) evaluateComposite() {
+	if len(a.Children) == 0 {
+		// every child was expanded from a template whose series have gone
+		a.Status = "Error"
+		a.Message = "no children left"
+		return
+	}
+	var failing []string
+	for _, c := range a.Children {
+		if c.Status == "Error" {
+			a.Status = "Error"
+			a.Message = fmt.Sprintf("%s errored: %s", c.Name, c.Message)
+			return
+		}
+		if c.Status == "Failed" {
+			failing = append(failing, c.Name)
+		}
+	}
+	for _, c := range a.Children {
+		if c.Status == "Pending" {
+			// wait until every child has been checked at least once
+			a.Status = "Pending"
+			a.Message = ""
+			return
+		}
+	}
+	a.Value = float64(len(failing))
+
+	var fired bool
+	switch strings.ToLower(a.Operator) {
+	case "or":
+		fired = len(failing) > 0
+	case "not":
+		fired = len(failing) == 0
+	case "k-of-n":
+		fired = len(failing) >= a.K
+	default:
+		fired = len(failing) == len(a.Children)
+	}
+	if !fired {
+		a.Status = "OK"
+		a.Message = ""
+		return
+	}
+	a.Status = "Failed"
+	if len(failing) == 0 {
+		a.Message = fmt.Sprintf("none of %d children failing", len(a.Children))
+		return
+	}
+	a.Message = fmt.Sprintf("%d of %d children failing: %s",
+		len(failing), len(a.Children), strings.Join(failing, ", "))
+}
+
+func (a *alert) ChildrenSummary() string {
+	summary := ""
+	for _, c := range a.Children {
+		summary += fmt.Sprintf("%s\t%s\n", c.Status, c.Name)
+	}
+	return summary
+}
+
+// linkComposite resolves the child names of a composite alert against
+// the alerts already in the collection.
+func (ac *alertsCollection) linkComposite(a *alert, d alertData) error {
+	switch strings.ToLower(d.Operator) {
+	case "", "and", "or":
+	case "not":
+		if len(d.Children) != 1 {
+			return fmt.Errorf("composite %q: \"not\" takes exactly one child", d.Name)
+		}
+	case "k-of-n":
+		if d.K < 1 || d.K > len(d.Children) {
+			return fmt.Errorf("composite %q: K must be between 1 and %d", d.Name, len(d.Children))
+		}
+	default:
+		return fmt.Errorf("composite %q: unknown operator %q", d.Name, d.Operator)
+	}
+	// the hash covers the children, so re-register under the new one
+	delete(ac.alertsByHash, a.Hash())
+	defer func() { ac.alertsByHash[a.Hash()] = a }()
+	a.composite = true
+	for _, name := range d.Children {
+		c := ac.byName(name)
+		if c == nil {
+			return fmt.Errorf("composite %q: no alert named %q", d.Name, name)
+		}
+		if c.Metric == "" {
+			return fmt.Errorf("composite %q: child %q has no metric of its own (composites can't be nested)", d.Name, name)
+		}
+		if d.MuteChildren {
+			c.Muted = true
+		}
+		a.Children = append(a.Children, c)
+	}
+	a.Operator = d.Operator
+	a.K = d.K
+	return nil
+}
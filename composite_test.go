@@ -0,0 +1,132 @@
+package main
+
+import (
+	"testing"
+)
+
+func compositeFixture(t *testing.T, d alertData) (*alertsCollection, *alert, *alert, *alert) {
+	ac := newAlertsCollection(DummyEmailer{})
+	c1 := newAlert("one", "one", "", 10, "above", DummyFetcher{}, "test@example.com", "")
+	c2 := newAlert("two", "two", "", 10, "above", DummyFetcher{}, "test@example.com", "")
+	c1.Status = "OK"
+	c2.Status = "OK"
+	ac.addAlert(c1)
+	ac.addAlert(c2)
+	a := newAlert(d.Name, "", "", 0, "", DummyFetcher{}, "test@example.com", "")
+	ac.addAlert(a)
+	if err := ac.linkComposite(a, d); err != nil {
+		t.Fatal(err)
+	}
+	return ac, a, c1, c2
+}
+
+func Test_evaluateCompositeAnd(t *testing.T) {
+	_, a, c1, c2 := compositeFixture(t, alertData{Name: "both", Children: []string{"one", "two"}})
+	c1.Status = "Failed"
+	a.evaluateComposite()
+	if a.Status != "OK" {
+		t.Error("and with one child failing should pass")
+	}
+	c2.Status = "Failed"
+	a.evaluateComposite()
+	if a.Status != "Failed" {
+		t.Error("and with both children failing should fail")
+	}
+	c2.Status = "Error"
+	a.evaluateComposite()
+	if a.Status != "Error" {
+		t.Error("a child error should make the composite an error")
+	}
+	c2.Status = "Pending"
+	a.evaluateComposite()
+	if a.Status != "Pending" {
+		t.Error("a pending child should keep the composite pending")
+	}
+}
+
+func Test_evaluateCompositeOperators(t *testing.T) {
+	_, a, c1, _ := compositeFixture(t, alertData{Name: "either", Children: []string{"one", "two"}, Operator: "OR"})
+	c1.Status = "Failed"
+	a.evaluateComposite()
+	if a.Status != "Failed" {
+		t.Error("or with one child failing should fail")
+	}
+
+	_, a, c1, _ = compositeFixture(t, alertData{Name: "neither", Children: []string{"one"}, Operator: "not"})
+	a.evaluateComposite()
+	if a.Status != "Failed" {
+		t.Error("not with a passing child should fail")
+	}
+	c1.Status = "Failed"
+	a.evaluateComposite()
+	if a.Status != "OK" {
+		t.Error("not with a failing child should pass")
+	}
+
+	_, a, c1, _ = compositeFixture(t, alertData{Name: "some", Children: []string{"one", "two"}, Operator: "k-of-n", K: 1})
+	c1.Status = "Failed"
+	a.evaluateComposite()
+	if a.Status != "Failed" || a.Value != 1 {
+		t.Error("1-of-2 with one child failing should fail")
+	}
+}
+
+func Test_linkCompositeErrors(t *testing.T) {
+	ac := newAlertsCollection(DummyEmailer{})
+	ac.addAlert(newAlert("one", "one", "", 10, "above", DummyFetcher{}, "test@example.com", ""))
+	a := newAlert("bad", "", "", 0, "", DummyFetcher{}, "test@example.com", "")
+	ac.addAlert(a)
+	if ac.linkComposite(a, alertData{Name: "bad", Children: []string{"missing"}}) == nil {
+		t.Error("expected an error for an unknown child")
+	}
+	if ac.linkComposite(a, alertData{Name: "bad", Children: []string{"one"}, Operator: "xor"}) == nil {
+		t.Error("expected an error for an unknown operator")
+	}
+	if ac.linkComposite(a, alertData{Name: "bad", Children: []string{"one"}, Operator: "k-of-n", K: 2}) == nil {
+		t.Error("expected an error for K out of range")
+	}
+	if ac.linkComposite(a, alertData{Name: "bad", Children: []string{"bad"}}) == nil {
+		t.Error("expected an error for a composite child")
+	}
+}
+
+func Test_MuteChildren(t *testing.T) {
+	ac, a, c1, _ := compositeFixture(t, alertData{Name: "both", Children: []string{"one", "two"}, MuteChildren: true})
+	if !c1.Muted {
+		t.Error("children should be muted")
+	}
+	if ac.byHash(a.Hash()) != a {
+		t.Error("composite should be registered under its linked hash")
+	}
+	c1.Status = "Failed"
+	_, _, _, f, as := c1.UpdateState(0)
+	if f != 1 || as != 0 {
+		t.Error("a muted child should count as failed without sending")
+	}
+}
+
+func Test_UpdateStateCompositePending(t *testing.T) {
+	q, _ := newNotificationQueue("", 1)
+	outbox = q
+	savedThrottle := globalThrottle
+	globalThrottle = 10
+	defer func() { outbox, globalThrottle = nil, savedThrottle }()
+	ac, a, c1, c2 := compositeFixture(t, alertData{Name: "both", Children: []string{"one", "two"}})
+	c1.Status = "Failed"
+	c2.Status = "Pending"
+	a.evaluateComposite()
+	lastAlerted := a.LastAlerted
+	_, _, _, f, _ := a.UpdateState(0)
+	if a.Status != "Pending" || f != 0 || a.Backoff != 0 || !a.LastAlerted.Equal(lastAlerted) || !a.IncidentStart.IsZero() {
+		t.Errorf("a pending composite shouldn't count or back off: %d failures, backoff %d, alerted %v, incident %v", f, a.Backoff, a.LastAlerted, a.IncidentStart)
+	}
+
+	c2.Status = "Failed"
+	a.evaluateComposite()
+	if _, _, _, f, as := a.UpdateState(0); f != 1 || as != 1 || q.Pending() != 1 {
+		t.Errorf("expected the composite's first failure to alert, got %d failures, %d sent", f, as)
+	}
+	if ac.byHash(a.Hash()) != a {
+		t.Error("composite should be registered under its linked hash")
+	}
+}
@@ -7,9 +7,129 @@ type alertData struct {
 	Threshold   float64
 	Direction   string
 	EmailTo     string
+	EmailCc     string
+	EmailBcc    string
 	RunBookLink string
+	// Evaluator selects how the fetched value is judged: "" or
+	// "threshold" (the default), "change", "weekly" or "stddev".
+	Evaluator      string
+	BaselineWindow string
+	// Children makes this a composite alert over the named alerts,
+	// combined with Operator: "and", "or", "not" or "k-of-n".
+	Children     []string
+	Operator     string
+	K            int
+	MuteChildren bool
+	DependsOn    []string
+	// CheckInterval (minutes) and Window override the global settings
+	// for this alert
+	CheckInterval int
+	Window        string
+	// Templates is a text/template file overriding some or all of the
+	// notification templates for this alert
+	Templates string
+	// Escalation names the escalation policy for when nobody
+	// acknowledges this alert
+	Escalation string
+	// NotificationWindow names the window this alert may notify in,
+	// overriding any window for its Type
+	NotificationWindow string
+	// Labels like {"team": "ops", "env": "prod"} group alerts for
+	// routing and filtering
+	Labels map[string]string
+	// Expand makes this a template for one alert per series matching
+	// a graphite wildcard like "app.smoketest.*.failed". Name, Metric,
+	// RunBookLink and Labels are text/templates of the match:
+	// {{.Path}}, {{.Node 2}}, {{.Match 0}}
+	Expand string
+	// ExpandedFrom is the template an expanded alert came from
+	ExpandedFrom string `json:"-"`
+	// Source is the config file the alert is in
+	Source string `json:"-"`
+}
+
+// scheduleData is an on-call rotation. Alerts page whoever is on call
+// by putting "oncall:<Name>" in EmailTo, EmailCc or EmailBcc.
+type scheduleData struct {
+	Name string
+	// TimeZone is an IANA name like "America/New_York", default UTC
+	TimeZone string
+	// Rotation takes turns, each for ShiftDays (default 7) days,
+	// starting with the first at Start ("2006-01-02T15:04")
+	Rotation  []string
+	Start     string
+	ShiftDays int
+	Overrides []overrideData
+}
+
+type overrideData struct {
+	Start string
+	End   string
+	Who   string
+}
+
+// escalationData is a policy for alerts nobody acknowledges. Each tier
+// is notified once, when the alert has been failing for After minutes.
+type escalationData struct {
+	Name  string
+	Tiers []tierData
+}
+
+type tierData struct {
+	After int
+	// Channel is "email" (the default) or "webhook"
+	Channel string
+	EmailTo string
+	EmailCc string
+	URL     string
+}
+
+// notificationWindowData is when alerts may notify, eg business hours.
+// Notifications outside it are dropped, deferred until it next opens,
+// or rolled into a digest sent when it opens, depending on Outside.
+type notificationWindowData struct {
+	Name     string
+	TimeZone string
+	// Days like "Mon", default every day; Start and End like "09:00"
+	Days  []string
+	Start string
+	End   string
+	// Outside is "drop", "defer" or "digest"
+	Outside string
+	// Types makes this the window for every alert of these types
+	Types []string
+}
+
+// receiverData is a named set of recipients for routes to send to.
+type receiverData struct {
+	Name     string
+	EmailTo  string
+	EmailCc  string
+	EmailBcc string
+}
+
+// routeData is a node in the routing tree. An alert that matches it
+// goes on to the first of its Routes it also matches, or to its
+// Receiver if none do. With Continue, an alert matching a route also
+// carries on to its later siblings.
+type routeData struct {
+	// Match is labels that must be equal, MatchRE labels that must
+	// match a regular expression
+	Match    map[string]string
+	MatchRE  map[string]string
+	Receiver string
+	Continue bool
+	Routes   []routeData
 }
 
 type configData struct {
-	Alerts []alertData
+	Alerts              []alertData
+	Schedules           []scheduleData
+	Escalations         []escalationData
+	NotificationWindows []notificationWindowData
+	Receivers           []receiverData
+	Route               *routeData
+	// Settings are the same as the HOUND_* variables, which override
+	// them
+	Settings *config
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The alerts config can be one file, a directory, or a glob like
+// "conf.d/*.yaml", so each team can keep its alerts in a file of its
+// own. Files are JSON or YAML (.yaml or .yml) with the same fields,
+// and are merged in name order.
+
+// configExtensions are the files picked up from a directory.
+var configExtensions = map[string]bool{".json": true, ".yaml": true, ".yml": true}
+
+// configFiles is every file path names, in order.
+func configFiles(path string) ([]string, error) {
+	if strings.ContainsAny(path, "*?[") {
+		files, err := filepath.Glob(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("%s: no config files match", path)
+		}
+		sort.Strings(files)
+		return files, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		if !e.IsDir() && configExtensions[strings.ToLower(filepath.Ext(e.Name()))] {
+			files = append(files, filepath.Join(path, e.Name()))
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s: no .json, .yaml or .yml files", path)
+	}
+	return files, nil
+}
+
+// readConfigFile parses one file. YAML goes through JSON on the way so
+// both take exactly the same field names.
+func readConfigFile(file string) (configData, error) {
+	f := configData{}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return f, err
+	}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		var v interface{}
+		if err = yaml.Unmarshal(b, &v); err != nil {
+			return f, fmt.Errorf("%s: %v", file, err)
+		}
+		if b, err = json.Marshal(v); err != nil {
+			return f, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	if err = json.Unmarshal(b, &f); err != nil {
+		return f, fmt.Errorf("%s: %v", file, err)
+	}
+	for i := range f.Alerts {
+		f.Alerts[i].Source = file
+	}
+	return f, nil
+}
+
+// readConfig reads and merges every file path names. An alert name can
+// only be used once across all of them, and only one file can have the
+// routing tree or the settings.
+func readConfig(path string) (configData, error) {
+	merged := configData{}
+	files, err := configFiles(path)
+	if err != nil {
+		return merged, err
+	}
+	sources := make(map[string]string)
+	routeSource, settingsSource := "", ""
+	for _, file := range files {
+		f, err := readConfigFile(file)
+		if err != nil {
+			return merged, err
+		}
+		for _, a := range f.Alerts {
+			if other, ok := sources[a.Name]; ok {
+				if other == file {
+					return merged, fmt.Errorf("%s: there is more than one alert called %q", file, a.Name)
+				}
+				return merged, fmt.Errorf("alert %q is in both %s and %s", a.Name, other, file)
+			}
+			sources[a.Name] = file
+		}
+		if f.Route != nil {
+			if routeSource != "" {
+				return merged, fmt.Errorf("%s and %s both have a Route", routeSource, file)
+			}
+			routeSource = file
+			merged.Route = f.Route
+		}
+		if f.Settings != nil {
+			if settingsSource != "" {
+				return merged, fmt.Errorf("%s and %s both have Settings", settingsSource, file)
+			}
+			settingsSource = file
+			merged.Settings = f.Settings
+		}
+		merged.Alerts = append(merged.Alerts, f.Alerts...)
+		merged.Schedules = append(merged.Schedules, f.Schedules...)
+		merged.Escalations = append(merged.Escalations, f.Escalations...)
+		merged.NotificationWindows = append(merged.NotificationWindows, f.NotificationWindows...)
+		merged.Receivers = append(merged.Receivers, f.Receivers...)
+	}
+	return merged, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+const opsYAML = `
+Alerts:
+  - Name: disk full
+    Metric: servers.*.disk.used
+    Threshold: 90
+    Direction: above
+    Labels:
+      team: ops
+Receivers:
+  - Name: ops
+    EmailTo: ops@example.com
+Route:
+  Receiver: ops
+`
+
+const appsJSON = `{"Alerts": [
+    {"Name": "capsim smoketests", "Metric": "app.smoketest.capsim.failed", "Threshold": 0.5, "Direction": "above"}
+]}`
+
+func Test_readConfigDirectory(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"ops.yaml":  opsYAML,
+		"apps.json": appsJSON,
+		"README":    "not config",
+	})
+	f, err := readConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Alerts) != 2 {
+		t.Fatalf("expected 2 alerts, got %d", len(f.Alerts))
+	}
+	// files are read in name order
+	a := f.Alerts[1]
+	if a.Name != "disk full" || a.Threshold != 90 || a.Labels["team"] != "ops" {
+		t.Errorf("YAML alert read wrong: %+v", a)
+	}
+	if a.Source != filepath.Join(dir, "ops.yaml") || f.Alerts[0].Source != filepath.Join(dir, "apps.json") {
+		t.Errorf("wrong sources: %s, %s", f.Alerts[0].Source, a.Source)
+	}
+	if len(f.Receivers) != 1 || f.Route == nil || f.Route.Receiver != "ops" {
+		t.Errorf("receivers and route not merged: %+v", f)
+	}
+
+	f, err = readConfig(filepath.Join(dir, "*.json"))
+	if err != nil || len(f.Alerts) != 1 || f.Alerts[0].Name != "capsim smoketests" {
+		t.Errorf("glob should pick up just the JSON file: %v, %+v", err, f.Alerts)
+	}
+	f, err = readConfig(filepath.Join(dir, "ops.yaml"))
+	if err != nil || len(f.Alerts) != 1 {
+		t.Errorf("single file: %v, %+v", err, f.Alerts)
+	}
+}
+
+func Test_readConfigErrors(t *testing.T) {
+	for name, files := range map[string]map[string]string{
+		"is in both": {
+			"a.json": appsJSON,
+			"b.json": appsJSON,
+		},
+		"more than one alert": {
+			"a.yml": "Alerts:\n  - Name: x\n  - Name: x\n",
+		},
+		"both have a Route": {
+			"a.yaml": opsYAML,
+			"b.yml":  "Route:\n  Receiver: ops\n",
+		},
+		"b.yaml": {
+			"a.json": appsJSON,
+			"b.yaml": "Alerts: [\n",
+		},
+		"no .json": {
+			"README": "",
+		},
+	} {
+		_, err := readConfig(writeConfigFiles(t, files))
+		if err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("expected an error about %q, got %v", name, err)
+		}
+	}
+	if _, err := readConfig(filepath.Join(t.TempDir(), "*.yaml")); err == nil {
+		t.Error("expected an error for a glob matching nothing")
+	}
+}
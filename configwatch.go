@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// With HOUND_WATCH_CONFIG set, Hound reloads the config by itself when
+// it changes, rather than waiting for a SIGHUP. It uses inotify (or
+// whatever the platform has) where it can and polls where it can't.
+// Editors and deploys tend to write several times in quick succession,
+// so nothing happens until the files have been left alone for a moment,
+// and only a change to what's in them counts.
+
+// configDebounce is how long the config has to be left alone before
+// it's reloaded.
+var configDebounce = 2 * time.Second
+
+type configWatcher struct {
+	path     string
+	poll     time.Duration
+	debounce time.Duration
+	last     string
+}
+
+func newConfigWatcher(path string, poll time.Duration) *configWatcher {
+	return &configWatcher{path: path, poll: poll, debounce: configDebounce,
+		last: configFingerprint(path)}
+}
+
+// configFingerprint is a hash of the names and contents of every config
+// file, or "" if there aren't any to read.
+func configFingerprint(path string) string {
+	files, err := configFiles(path)
+	if err != nil {
+		return ""
+	}
+	h := sha1.New()
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return ""
+		}
+		io.WriteString(h, file)
+		h.Write(b)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// watchDir is the directory that changes when path does. Files are
+// often replaced rather than written to, so it's the directory that's
+// watched rather than the files in it.
+func watchDir(path string) string {
+	if strings.ContainsAny(path, "*?[") {
+		return filepath.Dir(path)
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return path
+	}
+	return filepath.Dir(path)
+}
+
+// relevant says whether a change to file could change the config.
+func (w *configWatcher) relevant(file string) bool {
+	if strings.ContainsAny(w.path, "*?[") {
+		ok, _ := filepath.Match(filepath.Clean(w.path), filepath.Clean(file))
+		return ok
+	}
+	if filepath.Clean(file) == filepath.Clean(w.path) {
+		return true
+	}
+	return filepath.Dir(file) == filepath.Clean(w.path) &&
+		configExtensions[strings.ToLower(filepath.Ext(file))]
+}
+
+// Run sends on changes whenever the config has changed and settled,
+// until ctx is cancelled.
+func (w *configWatcher) Run(ctx context.Context, changes chan<- struct{}) {
+	events := w.events(ctx)
+	var settle <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-events:
+			// start waiting again from the latest change
+			settle = time.After(w.debounce)
+		case <-settle:
+			settle = nil
+			fp := configFingerprint(w.path)
+			if fp == w.last || fp == "" {
+				continue
+			}
+			w.last = fp
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// events ticks whenever the config might have changed.
+func (w *configWatcher) events(ctx context.Context) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+	fw, err := fsnotify.NewWatcher()
+	if err == nil {
+		if err = fw.Add(watchDir(w.path)); err != nil {
+			fw.Close()
+		}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":    fmt.Sprintf("%v", err),
+			"interval": w.poll,
+		}).Warn("can't watch the config for changes, polling it instead")
+		go func() {
+			ticker := time.NewTicker(w.poll)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					notify()
+				}
+			}
+		}()
+		return ch
+	}
+	go func() {
+		defer fw.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e, ok := <-fw.Events:
+				if !ok {
+					return
+				}
+				if w.relevant(e.Name) {
+					notify()
+				}
+			case err, ok := <-fw.Errors:
+				if !ok {
+					return
+				}
+				log.WithFields(log.Fields{
+					"error": fmt.Sprintf("%v", err),
+				}).Warn("error watching the config")
+			}
+		}
+	}()
+	return ch
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func expectChange(t *testing.T, changes chan struct{}, want bool, what string) {
+	wait := time.Second
+	if !want {
+		wait = 300 * time.Millisecond
+	}
+	select {
+	case <-changes:
+		if !want {
+			t.Errorf("%s: unexpected reload", what)
+		}
+	case <-time.After(wait):
+		if want {
+			t.Errorf("%s: expected a reload", what)
+		}
+	}
+}
+
+func Test_configWatcher(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{"config.json": appsJSON})
+	path := filepath.Join(dir, "config.json")
+	w := newConfigWatcher(path, time.Hour)
+	w.debounce = 50 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan struct{}, 1)
+	go w.Run(ctx, changes)
+	// give the watcher a moment to start
+	time.Sleep(50 * time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		ioutil.WriteFile(path, []byte(appsJSON+"\n"+string(rune('a'+i))), 0644)
+		time.Sleep(10 * time.Millisecond)
+	}
+	expectChange(t, changes, true, "edits")
+	select {
+	case <-changes:
+		t.Error("a burst of edits should only reload once")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// writing the same thing again isn't a change
+	content, _ := ioutil.ReadFile(path)
+	ioutil.WriteFile(path, content, 0644)
+	expectChange(t, changes, false, "same content")
+
+	// nor is a file that isn't config
+	ioutil.WriteFile(filepath.Join(dir, "hound-queue.json.tmp"), []byte("{}"), 0644)
+	expectChange(t, changes, false, "other file")
+}
+
+func Test_configWatcherPolling(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "conf.d")
+	// the directory doesn't exist yet, so it can't be watched
+	w := newConfigWatcher(filepath.Join(dir, "*.yaml"), 20*time.Millisecond)
+	w.debounce = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan struct{}, 1)
+	go w.Run(ctx, changes)
+	time.Sleep(50 * time.Millisecond)
+
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "ops.yaml"), []byte(opsYAML), 0644)
+	expectChange(t, changes, true, "new file")
+}
+
+func Test_configWatcherRelevant(t *testing.T) {
+	for path, files := range map[string]map[string]bool{
+		"conf/config.json": {"conf/config.json": true, "conf/other.json": false},
+		"./conf.d/*.yaml":  {"conf.d/a.yaml": true, "conf.d/a.json": false},
+	} {
+		w := &configWatcher{path: path}
+		for file, want := range files {
+			if w.relevant(file) != want {
+				t.Errorf("%s: %s should be %v", path, file, want)
+			}
+		}
+	}
+	dir := writeConfigFiles(t, map[string]string{"a.yml": ""})
+	w := &configWatcher{path: dir}
+	if !w.relevant(filepath.Join(dir, "b.json")) || w.relevant(filepath.Join(dir, "README")) {
+		t.Error("a directory's config files are relevant, and nothing else")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type rootCauseGroup struct {
+	Alert      *alert
+	Suppressed []*alert
+}
+
+func (a alert) down() bool {
+	return a.Status == "Failed" || a.Status == "Error"
+}
+
+// Suppressed reports whether any alert this one depends on is currently
+// down, in which case this one's notifications would just be noise.
+func (a alert) Suppressed() bool {
+	for _, p := range a.Parents {
+		if p.down() {
+			return true
+		}
+	}
+	return false
+}
+
+// RootCause follows the failing parents up to the first one that isn't
+// itself suppressed. Returns nil if this alert isn't suppressed.
+func (a alert) RootCause() *alert {
+	for _, p := range a.Parents {
+		if !p.down() {
+			continue
+		}
+		if r := p.RootCause(); r != nil {
+			return r
+		}
+		return p
+	}
+	return nil
+}
+
+// linkDependencies resolves the names in DependsOn against the alerts
+// already in the collection.
+func (ac *alertsCollection) linkDependencies(a *alert, d alertData) error {
+	for _, name := range d.DependsOn {
+		p := ac.byName(name)
+		if p == nil {
+			return fmt.Errorf("alert %q depends on unknown alert %q", d.Name, name)
+		}
+		a.Parents = append(a.Parents, p)
+	}
+	return nil
+}
+
+// checkDependencyCycles walks the DependsOn graph and reports the first
+// cycle it finds, since a cycle would let alerts suppress each other
+// forever.
+func (ac *alertsCollection) checkDependencyCycles() error {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[*alert]int)
+	var path []*alert
+
+	var visit func(a *alert) error
+	visit = func(a *alert) error {
+		switch state[a] {
+		case visiting:
+			var names []string
+			for i := len(path) - 1; i >= 0; i-- {
+				names = append([]string{path[i].Name}, names...)
+				if path[i] == a {
+					break
+				}
+			}
+			return fmt.Errorf("dependency cycle: %s -> %s", strings.Join(names, " -> "), a.Name)
+		case done:
+			return nil
+		}
+		state[a] = visiting
+		path = append(path, a)
+		for _, p := range a.Parents {
+			if err := visit(p); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[a] = done
+		return nil
+	}
+
+	for _, a := range ac.alerts {
+		if err := visit(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rootCauseGroups gathers the suppressed alerts under the root cause
+// that is suppressing them, in the order the root causes appear.
+func rootCauseGroups(alerts []*alert) []rootCauseGroup {
+	var groups []rootCauseGroup
+	index := make(map[*alert]int)
+	for _, a := range alerts {
+		r := a.RootCause()
+		if r == nil {
+			continue
+		}
+		i, ok := index[r]
+		if !ok {
+			i = len(groups)
+			index[r] = i
+			groups = append(groups, rootCauseGroup{Alert: r})
+		}
+		groups[i].Suppressed = append(groups[i].Suppressed, a)
+	}
+	return groups
+}
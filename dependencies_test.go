@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func dependencyFixture(t *testing.T) (*alertsCollection, *alert, *alert, *alert) {
+	ac := newAlertsCollection(DummyEmailer{})
+	lb := newAlert("lb", "lb", "", 10, "above", DummyFetcher{}, "test@example.com", "")
+	app := newAlert("app", "app", "", 10, "above", DummyFetcher{}, "test@example.com", "")
+	smoke := newAlert("smoke", "smoke", "", 10, "above", DummyFetcher{}, "test@example.com", "")
+	ac.addAlert(lb)
+	ac.addAlert(app)
+	ac.addAlert(smoke)
+	if err := ac.linkDependencies(app, alertData{Name: "app", DependsOn: []string{"lb"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ac.linkDependencies(smoke, alertData{Name: "smoke", DependsOn: []string{"app"}}); err != nil {
+		t.Fatal(err)
+	}
+	return ac, lb, app, smoke
+}
+
+func Test_RootCause(t *testing.T) {
+	ac, lb, app, smoke := dependencyFixture(t)
+	if smoke.Suppressed() || smoke.RootCause() != nil {
+		t.Error("nothing is down yet")
+	}
+	lb.Status = "Failed"
+	app.Status = "Failed"
+	smoke.Status = "Failed"
+	if !smoke.Suppressed() {
+		t.Error("smoke should be suppressed")
+	}
+	if smoke.RootCause() != lb {
+		t.Error("lb should be the root cause")
+	}
+	groups := rootCauseGroups(ac.alerts)
+	if len(groups) != 1 || groups[0].Alert != lb || len(groups[0].Suppressed) != 2 {
+		t.Error("expected app and smoke grouped under lb", groups)
+	}
+}
+
+func Test_checkDependencyCycles(t *testing.T) {
+	ac, lb, _, _ := dependencyFixture(t)
+	if err := ac.checkDependencyCycles(); err != nil {
+		t.Error("unexpected cycle", err)
+	}
+	ac.linkDependencies(lb, alertData{Name: "lb", DependsOn: []string{"smoke"}})
+	err := ac.checkDependencyCycles()
+	if err == nil {
+		t.Fatal("expected a cycle")
+	}
+	if !strings.Contains(err.Error(), "lb -> smoke -> app -> lb") {
+		t.Error("cycle not described:", err)
+	}
+}
+
+func Test_linkDependenciesUnknown(t *testing.T) {
+	ac := newAlertsCollection(DummyEmailer{})
+	a := newAlert("a", "a", "", 10, "above", DummyFetcher{}, "test@example.com", "")
+	ac.addAlert(a)
+	if ac.linkDependencies(a, alertData{Name: "a", DependsOn: []string{"missing"}}) == nil {
+		t.Error("expected an error for an unknown parent")
+	}
+}
+
+func Test_UpdateStateSuppressed(t *testing.T) {
+	_, lb, app, _ := dependencyFixture(t)
+	lb.Status = "Failed"
+	app.Status = "Failed"
+	_, _, _, f, as := app.UpdateState(0)
+	if f != 1 || as != 0 {
+		t.Error("a suppressed failure should count without sending")
+	}
+	if app.Backoff != 0 {
+		t.Error("a suppressed failure shouldn't advance the backoff")
+	}
+	if !app.suppressedIncident {
+		t.Error("the incident should be marked as suppressed")
+	}
+	lb.Status = "OK"
+	app.Status = "OK"
+	_, rs, _, _, _ := app.UpdateState(0)
+	if rs != 0 {
+		t.Error("an unannounced failure shouldn't announce its recovery")
+	}
+	if app.suppressedIncident {
+		t.Error("the suppressed incident should be over")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// In digest mode alerts and recoveries aren't mailed one by one. Each
+// is noted against everyone who would have got it, and at the end of
+// the cycle (or once the digest window has passed) each recipient gets
+// a single message listing them all.
+
+// digestEntry is what an alert looked like when it failed or recovered.
+type digestEntry struct {
+	Kind      string // "alert" or "recovery"
+	Name      string
+	Type      string
+	Status    string
+	Message   string
+	Metric    string
+	Value     float64
+	Threshold float64
+	Direction string
+	GraphURL  string
+	AlertURL  string
+	Time      time.Time
+}
+
+type digestNotificationData struct {
+	Recipient    string
+	Entries      []digestEntry
+	Alerts       int
+	Recoveries   int
+	DashboardURL string
+}
+
+type digestCollector struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	pending map[string][]digestEntry
+	since   time.Time
+}
+
+// digest is nil unless digest mode is on.
+var digest *digestCollector
+
+func newDigestCollector(window time.Duration) *digestCollector {
+	return &digestCollector{window: window, pending: make(map[string][]digestEntry)}
+}
+
+// SetWindow changes the window, keeping anything already collected.
+func (d *digestCollector) SetWindow(w time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.window = w
+}
+
+func (a *alert) digestEntry(kind string) digestEntry {
+	e := digestEntry{
+		Kind:      kind,
+		Name:      a.Name,
+		Type:      a.Type,
+		Status:    a.Status,
+		Message:   a.Message,
+		Metric:    a.Metric,
+		Value:     roundToFourPlaces(a.Value),
+		Threshold: a.Threshold,
+		Direction: a.Direction,
+		AlertURL:  a.notificationData().AlertURL,
+		Time:      time.Now(),
+	}
+	if !a.IsComposite() {
+		e.GraphURL = a.DailyGraphURL()
+	}
+	return e
+}
+
+// addToDigest notes the alert for everyone it would have been sent to.
+func (a *alert) addToDigest(kind string) {
+	m, pages := a.notificationRecipients(time.Now())
+	if kind == "alert" {
+		a.recordPages(pages)
+	}
+	digest.Add(m.recipients(), a.digestEntry(kind))
+}
+
+func (d *digestCollector) Add(recipients []string, e digestEntry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.pending) == 0 {
+		d.since = e.Time
+	}
+	for _, r := range recipients {
+		d.pending[r] = append(d.pending[r], e)
+	}
+}
+
+// Flush builds a message for each recipient with anything waiting, once
+// the window has passed.
+func (d *digestCollector) Flush(now time.Time) []mailMessage {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.pending) == 0 || (d.window > 0 && now.Before(d.since.Add(d.window))) {
+		return nil
+	}
+	var recipients []string
+	for r := range d.pending {
+		recipients = append(recipients, r)
+	}
+	sort.Strings(recipients)
+
+	var messages []mailMessage
+	for _, r := range recipients {
+		data := digestNotificationData{Recipient: r, Entries: d.pending[r], DashboardURL: dashboardURL}
+		for _, e := range data.Entries {
+			if e.Kind == "recovery" {
+				data.Recoveries++
+			} else {
+				data.Alerts++
+			}
+		}
+		messages = append(messages, mailMessage{
+			From:    emailFrom,
+			To:      r,
+			Subject: renderTemplate(notificationTemplates, "digest_subject", data),
+			Text:    renderTemplate(notificationTemplates, "digest_body", data),
+		})
+	}
+	log.WithFields(log.Fields{
+		"recipients": strings.Join(recipients, ", "),
+	}).Debug("sending digests")
+	d.pending = make(map[string][]digestEntry)
+	return messages
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_digestGroupsByRecipient(t *testing.T) {
+	digest = newDigestCollector(0)
+	defer func() { digest = nil }()
+
+	a := newAlert("disk", "servers.disk", "", 90, "above", DummyFetcher{}, "ops@example.com", "")
+	a.EmailCc = "dev@example.com"
+	a.Status = "Failed"
+	a.Value = 95
+	b := newAlert("load", "servers.load", "", 5, "above", DummyFetcher{}, "ops@example.com", "")
+	b.Status = "OK"
+	b.PreviousStatus = "Failed"
+
+	a.SendAlert()
+	b.SendRecoveryMessageIfNeeded(globalThrottle + 1)
+
+	messages := digest.Flush(time.Now())
+	if len(messages) != 2 {
+		t.Fatalf("expected a digest each for dev and ops, got %d", len(messages))
+	}
+	dev, ops := messages[0], messages[1]
+	if dev.To != "dev@example.com" || ops.To != "ops@example.com" {
+		t.Fatalf("unexpected recipients: %s, %s", dev.To, ops.To)
+	}
+	if ops.Subject != "[DIGEST] Hound: 1 alerting, 1 recovered" {
+		t.Errorf("unexpected subject: %s", ops.Subject)
+	}
+	for _, s := range []string{"[ALERT] disk", "Value:\t95 (above 90.000000)", "[RECOVERED] load", "Graph: <"} {
+		if !strings.Contains(ops.Text, s) {
+			t.Errorf("expected %q in\n%s", s, ops.Text)
+		}
+	}
+	if strings.Contains(dev.Text, "load") {
+		t.Error("dev shouldn't hear about load")
+	}
+	if len(digest.Flush(time.Now())) != 0 {
+		t.Error("a flushed digest should be empty")
+	}
+}
+
+func Test_digestWindow(t *testing.T) {
+	d := newDigestCollector(10 * time.Minute)
+	start := time.Now()
+	d.Add([]string{"ops@example.com"}, digestEntry{Kind: "alert", Name: "disk", Time: start})
+	if len(d.Flush(start.Add(5*time.Minute))) != 0 {
+		t.Error("shouldn't send before the window is up")
+	}
+	d.Add([]string{"ops@example.com"}, digestEntry{Kind: "alert", Name: "load", Time: start.Add(5 * time.Minute)})
+	messages := d.Flush(start.Add(10 * time.Minute))
+	if len(messages) != 1 || !strings.Contains(messages[0].Text, "disk") || !strings.Contains(messages[0].Text, "load") {
+		t.Errorf("expected one digest with both alerts, got %v", messages)
+	}
+}
@@ -1,8 +1,6 @@
 package main
 
-import (
-	"fmt"
-)
+import "time"
 
 type emailer interface {
 	EncounteredErrors(int, string)
@@ -13,38 +11,42 @@ type emailer interface {
 type smtpEmailer struct{}
 
 func (e smtpEmailer) Throttled(failures, globalThrottle int, emailTo string) {
-	simpleSendMail(
-		emailFrom,
-		emailTo,
-		"[ALERT] Hound is throttled",
-		fmt.Sprintf("%d metrics were not OK.\nHound stopped sending messages after %d.\n"+
-			"This probably indicates an infrastructure problem (network, graphite, etc)", failures,
-			globalThrottle))
+	queueMail(mailMessage{
+		From:    emailFrom,
+		To:      resolveGlobalOnCall(emailTo),
+		Subject: renderCollectionTemplate("throttled_subject", failures, globalThrottle),
+		Text:    renderCollectionTemplate("throttled_body", failures, globalThrottle),
+	})
 }
 
 func (e smtpEmailer) RecoveryThrottled(recoveriesSent, globalThrottle int, emailTo string) {
 	if !emailOnError {
 		return
 	}
-	simpleSendMail(
-		emailFrom,
-		emailTo,
-		"[ALERT] Hound is recovered",
-		fmt.Sprintf("%d metrics recovered.\nHound stopped sending individual messages after %d.\n",
-			recoveriesSent,
-			globalThrottle))
+	queueMail(mailMessage{
+		From:    emailFrom,
+		To:      resolveGlobalOnCall(emailTo),
+		Subject: renderCollectionTemplate("recovery_throttled_subject", recoveriesSent, globalThrottle),
+		Text:    renderCollectionTemplate("recovery_throttled_body", recoveriesSent, globalThrottle),
+	})
 }
 
 func (e smtpEmailer) EncounteredErrors(errors int, emailTo string) {
 	if !emailOnError {
 		return
 	}
-	simpleSendMail(
-		emailFrom,
-		emailTo,
-		"[ERROR] Hound encountered errors",
-		fmt.Sprintf("%d metrics had errors. If this is more than a couple, it usually "+
-			"means that Graphite has fallen behind. It doesn't necessarily mean "+
-			"that there are problems with the services, but it means that Hound "+
-			"is temporarily blind wrt these metrics.", errors))
+	queueMail(mailMessage{
+		From:    emailFrom,
+		To:      resolveGlobalOnCall(emailTo),
+		Subject: renderCollectionTemplate("errors_subject", errors, 0),
+		Text:    renderCollectionTemplate("errors_body", errors, 0),
+	})
+}
+
+// resolveGlobalOnCall puts whoever's on call in place of the on-call
+// schedules in one of the global lists, like HOUND_EMAIL_TO. Nobody's
+// recorded as paged, since the mail's about hound rather than an alert.
+func resolveGlobalOnCall(list string) string {
+	to, _ := resolveOnCall(list, time.Now())
+	return to
 }
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// An alert with an escalation policy notifies more people the longer it
+// goes unacknowledged. Its regular notifications go out as always; on
+// top of that each tier of the policy is notified once, when the alert
+// has been failing for that tier's After. Acknowledging the alert (from
+// its page on the dashboard) stops the escalation and the repeats until
+// it recovers. Only someone who was sent a notification can acknowledge
+// it: each incident has a secret token that's in the link they're sent.
+// Incidents and acknowledgements are saved to a file so a restart
+// doesn't start the escalation over.
+
+type escalationTier struct {
+	After   time.Duration
+	Channel string
+	EmailTo string
+	EmailCc string
+	URL     string
+}
+
+type escalationPolicy struct {
+	Name  string
+	Tiers []escalationTier
+}
+
+func newEscalationPolicy(d escalationData, schedules map[string]*onCallSchedule) (*escalationPolicy, error) {
+	if d.Name == "" {
+		return nil, errors.New("escalation policy without a name")
+	}
+	p := &escalationPolicy{Name: d.Name}
+	var last time.Duration
+	for i, t := range d.Tiers {
+		tier := escalationTier{
+			After:   time.Duration(t.After) * time.Minute,
+			Channel: t.Channel,
+			EmailTo: t.EmailTo,
+			EmailCc: t.EmailCc,
+			URL:     t.URL,
+		}
+		if tier.Channel == "" {
+			tier.Channel = emailChannel
+		}
+		if tier.After < last {
+			return nil, fmt.Errorf("escalation policy %s: tier %d comes before tier %d", d.Name, i+1, i)
+		}
+		last = tier.After
+		switch tier.Channel {
+		case emailChannel:
+			if tier.EmailTo == "" {
+				return nil, fmt.Errorf("escalation policy %s: tier %d has no EmailTo", d.Name, i+1)
+			}
+			if err := checkOnCallReferences(schedules, tier.EmailTo, tier.EmailCc); err != nil {
+				return nil, fmt.Errorf("escalation policy %s: %v", d.Name, err)
+			}
+		case webhookChannel:
+			if tier.URL == "" {
+				return nil, fmt.Errorf("escalation policy %s: tier %d has no URL", d.Name, i+1)
+			}
+		default:
+			return nil, fmt.Errorf("escalation policy %s: unknown channel %q", d.Name, tier.Channel)
+		}
+		p.Tiers = append(p.Tiers, tier)
+	}
+	if len(p.Tiers) == 0 {
+		return nil, fmt.Errorf("escalation policy %s has no tiers", d.Name)
+	}
+	return p, nil
+}
+
+// loadEscalationPolicies has to come after the on-call schedules, which
+// tiers can refer to.
+func loadEscalationPolicies(f configData, schedules map[string]*onCallSchedule) (map[string]*escalationPolicy, error) {
+	policies := make(map[string]*escalationPolicy)
+	for _, d := range f.Escalations {
+		p, err := newEscalationPolicy(d, schedules)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := policies[p.Name]; ok {
+			return nil, fmt.Errorf("duplicate escalation policy %s", p.Name)
+		}
+		policies[p.Name] = p
+	}
+	return policies, nil
+}
+
+// escalationRecord is an incident that's still open.
+type escalationRecord struct {
+	Started time.Time
+	// how many tiers have been notified
+	Notified int
+	AckedBy  string
+	AckedAt  time.Time
+	// Token has to be given to acknowledge it
+	Token string
+}
+
+var (
+	errNotFailing = errors.New("the alert isn't failing")
+	errBadToken   = errors.New("wrong or missing acknowledgement token")
+)
+
+func newAckToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// without a token nobody can acknowledge it, which is the
+		// safe way to fail
+		log.WithFields(log.Fields{"error": fmt.Sprintf("%v", err)}).Error("couldn't make an acknowledgement token")
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// escalationStore is shared between the checks and the HTTP handlers,
+// keyed by alert name, which unlike the hash stays the same when an
+// alert's threshold is changed.
+type escalationStore struct {
+	file string
+
+	mu      sync.Mutex
+	records map[string]*escalationRecord
+}
+
+var escalations *escalationStore
+
+// newEscalationStore picks up whatever was left in file. An empty file
+// name keeps it in memory only.
+func newEscalationStore(file string) (*escalationStore, error) {
+	s := &escalationStore{file: file, records: make(map[string]*escalationRecord)}
+	if file == "" {
+		return s, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &s.records); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	for _, r := range s.records {
+		if r.Token == "" {
+			r.Token = newAckToken()
+		}
+	}
+	return s, nil
+}
+
+// save must be called with mu held.
+func (s *escalationStore) save() {
+	if s.file == "" {
+		return
+	}
+	b, err := json.Marshal(s.records)
+	if err == nil {
+		tmp := s.file + ".tmp"
+		if err = ioutil.WriteFile(tmp, b, 0600); err == nil {
+			err = os.Rename(tmp, s.file)
+		}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"file":  s.file,
+			"error": fmt.Sprintf("%v", err),
+		}).Error("couldn't save escalations")
+	}
+}
+
+// open starts an incident, unless one is already open from before a
+// restart.
+func (s *escalationStore) open(name string, start time.Time) escalationRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.records[name]
+	if !ok {
+		r = &escalationRecord{Started: start, Token: newAckToken()}
+		s.records[name] = r
+		s.save()
+	}
+	return *r
+}
+
+func (s *escalationStore) lookup(name string) (escalationRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.records[name]
+	if !ok {
+		return escalationRecord{}, false
+	}
+	return *r, true
+}
+
+func (s *escalationStore) setNotified(name string, tiers int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.records[name]; ok {
+		r.Notified = tiers
+		s.save()
+	}
+}
+
+func (s *escalationStore) acknowledge(name, token, by string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.records[name]
+	if !ok {
+		return errNotFailing
+	}
+	if !r.validToken(token) {
+		return errBadToken
+	}
+	if r.AckedBy == "" {
+		r.AckedBy = by
+		r.AckedAt = now
+		s.save()
+	}
+	return nil
+}
+
+func (r escalationRecord) validToken(token string) bool {
+	return r.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(r.Token)) == 1
+}
+
+func (s *escalationStore) resolve(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.records[name]; ok {
+		delete(s.records, name)
+		s.save()
+	}
+}
+
+// prune drops the incidents of alerts that aren't in ac any more.
+func (s *escalationStore) prune(ac *alertsCollection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pruned := false
+	for name := range s.records {
+		if ac.byName(name) == nil {
+			delete(s.records, name)
+			pruned = true
+		}
+	}
+	if pruned {
+		s.save()
+	}
+}
+
+// Acknowledgement is who acknowledged the current incident and when,
+// nil if nobody has.
+func (a alert) Acknowledgement() *escalationRecord {
+	if escalations == nil {
+		return nil
+	}
+	r, ok := escalations.lookup(a.Name)
+	if !ok || r.AckedBy == "" {
+		return nil
+	}
+	return &r
+}
+
+func (a alert) Acknowledged() bool {
+	return a.Acknowledgement() != nil
+}
+
+// ackToken is what it takes to acknowledge the current incident, empty
+// if there isn't one.
+func (a alert) ackToken() string {
+	if escalations == nil {
+		return ""
+	}
+	r, _ := escalations.lookup(a.Name)
+	return r.Token
+}
+
+func (a *alert) openIncident(now time.Time) {
+	if escalations != nil {
+		escalations.open(a.Name, now)
+	}
+}
+
+func (a *alert) resolveIncident() {
+	if escalations != nil {
+		escalations.resolve(a.Name)
+	}
+}
+
+// escalateIfNeeded notifies every tier whose time has come.
+func (a *alert) escalateIfNeeded(now time.Time) {
+	if a.Escalation == nil || escalations == nil {
+		return
+	}
+	r := escalations.open(a.Name, now)
+	if r.AckedBy != "" {
+		return
+	}
+	for i := r.Notified; i < len(a.Escalation.Tiers); i++ {
+		tier := a.Escalation.Tiers[i]
+		if now.Sub(r.Started) < tier.After {
+			break
+		}
+		a.notifyTier(i, tier, now)
+		escalations.setNotified(a.Name, i+1)
+	}
+}
+
+func (a *alert) notifyTier(i int, tier escalationTier, now time.Time) {
+	log.WithFields(log.Fields{
+		"name":    a.Name,
+		"tier":    i + 1,
+		"channel": tier.Channel,
+	}).Info("escalating")
+	data := a.notificationData()
+	data.Tier = i + 1
+	t := a.templates
+	if t == nil {
+		t = notificationTemplates
+	}
+	m := mailMessage{
+		From:    emailFrom,
+		Subject: renderTemplate(t, "escalation_subject", data),
+		Text:    renderTemplate(t, "escalation_body", data),
+	}
+	if tier.Channel == webhookChannel {
+		queueWebhook(tier.URL, m)
+		return
+	}
+	var pages, p []pageRecord
+	m.To, pages = resolveOnCall(tier.EmailTo, now)
+	m.Cc, p = resolveOnCall(tier.EmailCc, now)
+	a.recordPages(append(pages, p...))
+	a.threadAlert(&m)
+	queueMail(m)
+}
+
+// acknowledgeHandler handles a POST to /alert/<hash>/ack, with who's
+// acknowledging in the "by" form field and the incident's token in
+// "token".
+func acknowledgeHandler(ac *alertsCollection, hash string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	a := ac.currentSnapshot().byHash[hash]
+	if a == nil || escalations == nil {
+		http.NotFound(w, r)
+		return
+	}
+	by := strings.TrimSpace(r.FormValue("by"))
+	if by == "" {
+		by = "dashboard"
+	}
+	switch err := escalations.acknowledge(a.Name, r.FormValue("token"), by, time.Now()); err {
+	case nil:
+	case errBadToken:
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	log.WithFields(log.Fields{"name": a.Name, "by": by}).Info("acknowledged")
+	http.Redirect(w, r, "/alert/"+hash+"/", http.StatusSeeOther)
+}
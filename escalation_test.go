@@ -0,0 +1,230 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEscalationPolicy(t *testing.T) *escalationPolicy {
+	p, err := newEscalationPolicy(escalationData{Name: "ops", Tiers: []tierData{
+		{After: 0, EmailTo: "tier1@example.com"},
+		{After: 15, EmailTo: "tier2@example.com", EmailCc: "boss@example.com"},
+		{After: 30, Channel: "webhook", URL: "https://chat.example.com/hooks/secret"},
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func Test_newEscalationPolicyErrors(t *testing.T) {
+	for _, d := range []escalationData{
+		{Name: "empty"},
+		{Name: "order", Tiers: []tierData{{After: 10, EmailTo: "a"}, {After: 5, EmailTo: "b"}}},
+		{Name: "noone", Tiers: []tierData{{After: 10}}},
+		{Name: "nourl", Tiers: []tierData{{Channel: "webhook"}}},
+		{Name: "pager", Tiers: []tierData{{Channel: "pager", EmailTo: "a"}}},
+		{Name: "oncall", Tiers: []tierData{{EmailTo: "oncall:nobody"}}},
+	} {
+		if _, err := newEscalationPolicy(d, nil); err == nil {
+			t.Errorf("expected policy %s to be rejected", d.Name)
+		}
+	}
+}
+
+func withEscalationTest(t *testing.T, file string) *notificationQueue {
+	store, err := newEscalationStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	escalations = store
+	q, _ := newNotificationQueue("", 1)
+	outbox = q
+	t.Cleanup(func() {
+		escalations = nil
+		outbox = nil
+	})
+	return q
+}
+
+func Test_escalateIfNeeded(t *testing.T) {
+	q := withEscalationTest(t, "")
+	a := newAlert("disk", "disk", "", 90, "above", DummyFetcher{}, "ops@example.com", "")
+	a.Escalation = testEscalationPolicy(t)
+	a.Status = "Failed"
+	start := time.Now()
+	a.startIncidentIfNeeded(start)
+
+	a.escalateIfNeeded(start)
+	if q.Pending() != 1 || q.pending[0].Message.To != "tier1@example.com" {
+		t.Fatalf("expected tier 1 to be notified straight away, got %d", q.Pending())
+	}
+	if !strings.HasPrefix(q.pending[0].Message.Subject, "[ESCALATED] disk (tier 1)") {
+		t.Errorf("unexpected subject: %s", q.pending[0].Message.Subject)
+	}
+	a.escalateIfNeeded(start.Add(10 * time.Minute))
+	if q.Pending() != 1 {
+		t.Fatal("tier 2 isn't due yet")
+	}
+	a.escalateIfNeeded(start.Add(31 * time.Minute))
+	if q.Pending() != 3 {
+		t.Fatalf("expected tiers 2 and 3, got %d", q.Pending())
+	}
+	if q.pending[1].Message.Cc != "boss@example.com" || q.pending[2].Channel != webhookChannel {
+		t.Errorf("unexpected tiers: %+v %+v", q.pending[1], q.pending[2])
+	}
+	if r := q.pending[2].Recipients(); r[0] != "webhook at chat.example.com" {
+		t.Errorf("the webhook URL shouldn't be shown: %v", r)
+	}
+	a.escalateIfNeeded(start.Add(time.Hour))
+	if q.Pending() != 3 {
+		t.Error("each tier should only be notified once")
+	}
+}
+
+func Test_acknowledgeStopsEscalation(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "escalations.json")
+	q := withEscalationTest(t, file)
+	a := newAlert("disk", "disk", "", 90, "above", DummyFetcher{}, "ops@example.com", "")
+	a.Escalation = testEscalationPolicy(t)
+	a.Status = "Failed"
+	start := time.Now()
+	a.startIncidentIfNeeded(start)
+	a.escalateIfNeeded(start)
+
+	if err := escalations.acknowledge(a.Name, "guess", "mallory", start); err != errBadToken {
+		t.Errorf("acknowledging without the token should fail, got %v", err)
+	}
+	if err := escalations.acknowledge(a.Name, a.ackToken(), "alice", start.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	// the acknowledgement survives a restart
+	if escalations, _ = newEscalationStore(file); !a.Acknowledged() || a.Acknowledgement().AckedBy != "alice" {
+		t.Fatal("expected the acknowledgement to be saved")
+	}
+	a.escalateIfNeeded(start.Add(time.Hour))
+	if q.Pending() != 1 {
+		t.Errorf("acknowledging should stop the escalation, got %d notifications", q.Pending())
+	}
+
+	a.Status = "OK"
+	a.PreviousStatus = "Failed"
+	a.UpdateState(0)
+	if _, ok := escalations.lookup(a.Name); ok {
+		t.Error("recovering should close the incident")
+	}
+	if err := escalations.acknowledge(a.Name, "", "alice", time.Now()); err != errNotFailing {
+		t.Error("there's nothing to acknowledge once it's recovered")
+	}
+}
+
+func Test_acknowledgeHandler(t *testing.T) {
+	withEscalationTest(t, "")
+	ac := newAlertsCollection(smtpEmailer{})
+	a := newAlert("disk", "disk", "", 90, "above", DummyFetcher{}, "ops@example.com", "")
+	ac.addAlert(a)
+	ac.publish()
+	path := "/alert/" + a.Hash() + "/ack"
+	mux := registerHandlers(ac, config{})
+
+	post := func(path, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path, strings.NewReader(url.Values{"by": {"bob"}, "token": {token}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	if w := post(path, ""); w.Code != http.StatusConflict {
+		t.Errorf("expected a conflict for a healthy alert, got %d", w.Code)
+	}
+	a.Status = "Failed"
+	a.startIncidentIfNeeded(time.Now())
+	token := a.ackToken()
+	for _, bad := range []string{"", "guess"} {
+		if w := post(path, bad); w.Code != http.StatusForbidden {
+			t.Errorf("expected token %q to be refused, got %d", bad, w.Code)
+		}
+	}
+	if a.Acknowledged() {
+		t.Fatal("acknowledged without the token")
+	}
+	if w := post(path, token); w.Code != http.StatusSeeOther {
+		t.Errorf("expected a redirect, got %d", w.Code)
+	}
+	if r := a.Acknowledgement(); r == nil || r.AckedBy != "bob" {
+		t.Errorf("unexpected acknowledgement: %v", r)
+	}
+	if w := post("/alert/nosuchalert/ack", token); w.Code != http.StatusNotFound {
+		t.Errorf("expected not found, got %d", w.Code)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected GET to be refused, got %d", w.Code)
+	}
+}
+
+func Test_ackLinks(t *testing.T) {
+	withEscalationTest(t, "")
+	saved := dashboardURL
+	dashboardURL = "https://hound.example.com/"
+	defer func() { dashboardURL = saved }()
+	ac := newAlertsCollection(smtpEmailer{})
+	a := newAlert("disk", "disk", "", 90, "above", DummyFetcher{}, "ops@example.com", "")
+	ac.addAlert(a)
+	ac.publish()
+	if d := a.notificationData(); d.AckURL != "" {
+		t.Errorf("nothing to acknowledge yet, got %q", d.AckURL)
+	}
+
+	a.Status = "Failed"
+	a.startIncidentIfNeeded(time.Now())
+	ac.publish()
+	d := a.notificationData()
+	if d.AckURL != d.AlertURL+"?ack="+a.ackToken() || !strings.Contains(a.alertEmailBody(), d.AckURL) {
+		t.Errorf("the notification should link to acknowledging it, got %q", d.AckURL)
+	}
+	if pr := ac.MakeindivPageResponse(a.Hash(), a.ackToken()); pr.AckToken != a.ackToken() {
+		t.Error("the page opened from the link should offer to acknowledge it")
+	}
+	if pr := ac.MakeindivPageResponse(a.Hash(), "guess"); pr.AckToken != "" {
+		t.Error("only the right token should offer to acknowledge it")
+	}
+
+	// with or without the trailing slash
+	mux := registerHandlers(ac, config{TemplateFile: "index.html"})
+	for _, path := range []string{"/alert/" + a.Hash() + "/", "/alert/" + a.Hash()} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", path+"?ack="+a.ackToken(), nil))
+		if !strings.Contains(w.Body.String(), "Acknowledge</button>") {
+			t.Errorf("%s: the acknowledge link should offer to acknowledge it", path)
+		}
+	}
+}
+
+func Test_escalationsPruned(t *testing.T) {
+	withEscalationTest(t, "")
+	old := buildTestCollection(t,
+		alertData{Name: "kept", Metric: "kept", Threshold: 1, Direction: "above"},
+		alertData{Name: "gone", Metric: "gone", Threshold: 1, Direction: "above"},
+	)
+	for _, a := range old.alerts {
+		a.openIncident(time.Now())
+	}
+	// a new threshold doesn't make it a different incident
+	ac := buildTestCollection(t,
+		alertData{Name: "kept", Metric: "kept", Threshold: 2, Direction: "above"},
+	)
+	ac.carryOver(old)
+	if _, ok := escalations.lookup("kept"); !ok {
+		t.Error("an alert that's still there should keep its incident")
+	}
+	if _, ok := escalations.lookup("gone"); ok {
+		t.Error("a removed alert's incident should be dropped")
+	}
+}
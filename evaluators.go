@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+)
+
+// evaluators are the values an alert's Evaluator can take.
+var evaluators = map[string]bool{"": true, "threshold": true, "change": true, "weekly": true, "stddev": true}
+
+func meanAndStddev(values []float64) (float64, float64) {
+	if len(values) == 0 {
+		return 0.0, 0.0
+	}
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+	variance := 0.0
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+	return mean, math.Sqrt(variance / float64(len(values)))
+}
+
+// fetchWindowBaseline pulls the whole baseline window and reads the
+// most recent datapoint of each series, with the baseline (and, for
+// "stddev", the deviation) computed from its earlier points.
+func (a *alert) fetchWindowBaseline() ([]seriesReading, error) {
+	series, err := a.fetchSeries(a.SeriesURL())
+	if err != nil {
+		return nil, err
+	}
+	readings := make([]seriesReading, len(series))
+	for i, s := range series {
+		r := seriesReading{Name: s.Name}
+		values := s.present()
+		switch {
+		case len(values) == 0:
+			r.err = errors.New("no datapoints in window")
+		case len(values) < 2:
+			r.err = errors.New("not enough datapoints in window")
+		case a.Evaluator == "change":
+			r.Value = values[len(values)-1]
+			r.Baseline = values[0]
+		default:
+			r.Value = values[len(values)-1]
+			r.Baseline, r.Deviation = meanAndStddev(values[:len(values)-1])
+		}
+		readings[i] = r
+	}
+	return readings, nil
+}
+
+// fetchWeeklyBaseline reads each series along with its value at the
+// same time last week. Series come and go, so they're paired up by name
+// rather than by where graphite put them, and one that wasn't there last
+// week has no baseline.
+func (a *alert) fetchWeeklyBaseline() ([]seriesReading, error) {
+	series, err := a.fetchSeries(a.URL())
+	if err != nil {
+		return nil, err
+	}
+	baselines, err := a.fetchSeries(a.WeeklyBaselineURL())
+	if err != nil {
+		return nil, err
+	}
+	lastWeek := make(map[string]graphiteSeries, len(baselines))
+	for _, b := range baselines {
+		lastWeek[unshiftedName(b.Name)] = b
+	}
+	readings := make([]seriesReading, len(series))
+	for i, s := range series {
+		r := seriesReading{Name: s.Name}
+		r.Value, r.err = s.last()
+		if r.err == nil {
+			b, ok := lastWeek[s.Name]
+			if !ok {
+				r.err = errors.New("last week: no such series")
+			} else if r.Baseline, r.err = b.last(); r.err != nil {
+				r.err = fmt.Errorf("last week: %v", r.err)
+			}
+		}
+		readings[i] = r
+	}
+	return readings, nil
+}
+
+var timeShiftName = regexp.MustCompile(`timeShift\((.*),\s*['"]?[-+]?\w+['"]?\)`)
+
+// unshiftedName is what graphite calls a time shifted series without
+// the shift, eg "keepLastValue(timeShift(foo, "7d"))" is
+// "keepLastValue(foo)".
+func unshiftedName(name string) string {
+	return timeShiftName.ReplaceAllString(name, "$1")
+}
+
+// updateChangeStatus treats the threshold as a percentage. "above" fails
+// when the value has risen at least that much over the baseline, "below"
+// when it has dropped at least that much.
+func (a *alert) updateChangeStatus(lv float64, baselineDescription string) {
+	if a.Baseline == 0 {
+		a.Status = "Error"
+		a.Message = fmt.Sprintf("baseline %s is zero", baselineDescription)
+		return
+	}
+	change := (lv - a.Baseline) / math.Abs(a.Baseline) * 100
+	a.Message = fmt.Sprintf("%f is a %f%% change from %f %s (threshold %f%%)",
+		lv, change, a.Baseline, baselineDescription, a.Threshold)
+	if a.Direction == "above" {
+		if change < a.Threshold {
+			a.Status = "OK"
+		} else {
+			a.Status = "Failed"
+		}
+	} else {
+		if change > -a.Threshold {
+			a.Status = "OK"
+		} else {
+			a.Status = "Failed"
+		}
+	}
+}
+
+// updateDeviationStatus treats the threshold as k in a mean ± k·stddev
+// band around the rolling baseline. Unlike a plain threshold, landing
+// exactly on the edge of the band passes, so a flat series doesn't fail.
+func (a *alert) updateDeviationStatus(lv float64) {
+	band := a.Threshold * a.Deviation
+	if a.Direction == "above" {
+		a.Message = fmt.Sprintf("%f against a rolling mean of %f + %f·%f (upper bound %f)",
+			lv, a.Baseline, a.Threshold, a.Deviation, a.Baseline+band)
+		if lv <= a.Baseline+band {
+			a.Status = "OK"
+		} else {
+			a.Status = "Failed"
+		}
+	} else {
+		a.Message = fmt.Sprintf("%f against a rolling mean of %f - %f·%f (lower bound %f)",
+			lv, a.Baseline, a.Threshold, a.Deviation, a.Baseline-band)
+		if lv >= a.Baseline-band {
+			a.Status = "OK"
+		} else {
+			a.Status = "Failed"
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// BodyFetcher answers every request with the body registered for the
+// first matching URL substring.
+type BodyFetcher map[string]string
+
+func (b BodyFetcher) Get(url string) (*http.Response, error) {
+	for k, v := range b {
+		if strings.Contains(url, k) {
+			return &http.Response{Status: "200 OK",
+				Body: ioutil.NopCloser(strings.NewReader(v))}, nil
+		}
+	}
+	return &http.Response{Status: "404 Not Found",
+		Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+}
+
+func Test_presentValues(t *testing.T) {
+	series, err := parseSeries("foo,1,2,60|1,None,3\n")
+	if err != nil {
+		t.Error("returned an error")
+	}
+	v := series[0].present()
+	if len(v) != 2 || v[0] != 1.0 || v[1] != 3.0 {
+		t.Error("wrong values parsed", v)
+	}
+	a := newAlert("foo", "foo", "", 2, "above", BodyFetcher{
+		"target=foo": "foo,1,2,60|None,None\n",
+	}, "test@example.com", "")
+	a.Evaluator = "stddev"
+	if a.CheckMetric() || a.Status != "Error" || a.Message != "no datapoints in window" {
+		t.Error("expected an error", a.Status, a.Message)
+	}
+}
+
+func Test_meanAndStddev(t *testing.T) {
+	m, sd := meanAndStddev([]float64{2, 4, 4, 4, 5, 5, 7, 9})
+	if m != 5.0 || sd != 2.0 {
+		t.Error("wrong mean/stddev", m, sd)
+	}
+}
+
+func Test_UpdateStatusChange(t *testing.T) {
+	a := newAlert("foo", "foo", "", 30, "below", DummyFetcher{}, "test@example.com", "")
+	a.Evaluator = "change"
+	a.Baseline = 100
+	a.UpdateStatus(80)
+	if a.Status != "OK" {
+		t.Error("a 20% drop should pass")
+	}
+	a.UpdateStatus(60)
+	if a.Status != "Failed" {
+		t.Error("a 40% drop should fail")
+	}
+	if !strings.Contains(a.Message, "100.000000") {
+		t.Error("message should explain the baseline:", a.Message)
+	}
+	a.Direction = "above"
+	a.UpdateStatus(140)
+	if a.Status != "Failed" {
+		t.Error("a 40% rise should fail")
+	}
+	a.Baseline = 0
+	a.UpdateStatus(140)
+	if a.Status != "Error" {
+		t.Error("a zero baseline should be an error")
+	}
+}
+
+func Test_UpdateStatusStddev(t *testing.T) {
+	a := newAlert("foo", "foo", "", 2, "above", DummyFetcher{}, "test@example.com", "")
+	a.Evaluator = "stddev"
+	a.Baseline = 10
+	a.Deviation = 1
+	a.UpdateStatus(12)
+	if a.Status != "OK" {
+		t.Error("inside the band should pass")
+	}
+	a.UpdateStatus(12.5)
+	if a.Status != "Failed" {
+		t.Error("outside the band should fail")
+	}
+	a.Direction = "below"
+	a.UpdateStatus(7.5)
+	if a.Status != "Failed" {
+		t.Error("below the band should fail")
+	}
+}
+
+func Test_CheckMetricWindowBaseline(t *testing.T) {
+	a := newAlert("foo", "foo", "", 2, "above", BodyFetcher{
+		"target=foo": "foo,1,2,60|10,11,9,10,11,9,30\n",
+	}, "test@example.com", "")
+	a.Evaluator = "stddev"
+	if a.CheckMetric() {
+		t.Error("spike should fail")
+	}
+	if a.Baseline != 10 || a.Value != 30 {
+		t.Error("wrong baseline or value", a.Baseline, a.Value)
+	}
+}
+
+func Test_CheckMetricWeekly(t *testing.T) {
+	a := newAlert("foo", "foo", "", 50, "below", BodyFetcher{
+		"timeShift":          "foo,1,2,60|190,200\n",
+		"keepLastValue(foo)": "foo,1,2,60|40,50\n",
+	}, "test@example.com", "")
+	a.Evaluator = "weekly"
+	if a.CheckMetric() {
+		t.Error("a 75% drop week over week should fail")
+	}
+	if a.Baseline != 200 {
+		t.Error("wrong baseline", a.Baseline)
+	}
+}
+
+func Test_CheckMetricWeeklyPairsByName(t *testing.T) {
+	a := newAlert("foo", "servers.*.load", "", 50, "below", BodyFetcher{
+		"timeShift": "keepLastValue(timeShift(servers.b.load, \"7d\")),1,2,60|100\n" +
+			"keepLastValue(timeShift(servers.a.load, '7d')),1,2,60|10\n" +
+			"keepLastValue(timeShift(servers.gone.load, \"7d\")),1,2,60|10\n",
+		"keepLastValue(servers": "keepLastValue(servers.a.load),1,2,60|10\n" +
+			"keepLastValue(servers.b.load),1,2,60|20\n" +
+			"keepLastValue(servers.new.load),1,2,60|5\n",
+	}, "test@example.com", "")
+	a.Evaluator = "weekly"
+	a.CheckMetric()
+	want := map[string]string{
+		"keepLastValue(servers.a.load)":   "OK",
+		"keepLastValue(servers.b.load)":   "Failed",
+		"keepLastValue(servers.new.load)": "Error",
+	}
+	if len(a.Series) != len(want) {
+		t.Fatalf("expected %d series, got %+v", len(want), a.Series)
+	}
+	for _, s := range a.Series {
+		if want[s.Name] != s.Status {
+			t.Errorf("%s: expected %s, got %s (%s)", s.Name, want[s.Name], s.Status, s.Message)
+		}
+	}
+}
+
+func Test_unshiftedName(t *testing.T) {
+	for shifted, name := range map[string]string{
+		`keepLastValue(timeShift(foo.bar, "7d"))`:         "keepLastValue(foo.bar)",
+		`keepLastValue(timeShift(sumSeries(a,b), '-7d'))`: "keepLastValue(sumSeries(a,b))",
+		"foo": "foo",
+	} {
+		if got := unshiftedName(shifted); got != name {
+			t.Errorf("%s: expected %s, got %s", shifted, name, got)
+		}
+	}
+}
+
+func Test_unknownEvaluator(t *testing.T) {
+	_, err := buildAlertsCollection(configData{Alerts: []alertData{
+		{Name: "foo", Metric: "foo", Threshold: 1, Direction: "above", Evaluator: "median"},
+	}}, config{EmailTo: "ops@example.com"})
+	if err == nil || !strings.Contains(err.Error(), `unknown evaluator "median"`) {
+		t.Error("expected an unknown evaluator error, got", err)
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// An alert with Expand set is a template rather than an alert. Expand
+// is a graphite wildcard like app.smoketest.*.failed; every series the
+// graphite /metrics/find API matches becomes an alert of its own, with
+// Name, Metric, RunBookLink and Labels filled in from the match. The
+// wildcard is expanded again every so often, so new series get alerts
+// and alerts for series that have gone away are dropped.
+
+// graphiteFinder asks graphite's /metrics/find which series match a
+// wildcard. Each collection has its own, so a reload expands its
+// templates with the new settings before they're put into effect.
+type graphiteFinder struct {
+	base    string
+	fetcher fetcher
+}
+
+// defaultExpandInterval is how often wildcards are expanded again.
+const defaultExpandInterval = 15 * time.Minute
+
+// expandMatch is what the templated fields are rendered with.
+type expandMatch struct {
+	// Path is the full name of the matched series
+	Path    string
+	nodes   []string
+	matches []string
+}
+
+// Node is the nth dot-separated part of the path, counting from zero,
+// or from the end if n is negative.
+func (m expandMatch) Node(n int) string {
+	if n < 0 {
+		n += len(m.nodes)
+	}
+	if n < 0 || n >= len(m.nodes) {
+		return ""
+	}
+	return m.nodes[n]
+}
+
+// Match is the part of the path matched by the nth wildcard node.
+func (m expandMatch) Match(n int) string {
+	if n < 0 || n >= len(m.matches) {
+		return ""
+	}
+	return m.matches[n]
+}
+
+func newExpandMatch(pattern, path string) expandMatch {
+	m := expandMatch{Path: path, nodes: strings.Split(path, ".")}
+	for i, p := range strings.Split(pattern, ".") {
+		if i < len(m.nodes) && strings.ContainsAny(p, "*?[{") {
+			m.matches = append(m.matches, m.nodes[i])
+		}
+	}
+	return m
+}
+
+// alertExpansion is one templated alert and what it currently expands to.
+type alertExpansion struct {
+	data        alertData
+	name        *template.Template
+	metric      *template.Template
+	runBookLink *template.Template
+	labels      map[string]*template.Template
+	// names of the alerts generated last time
+	generated map[string]bool
+}
+
+func newAlertExpansion(d alertData) (*alertExpansion, error) {
+	if len(d.Children) > 0 {
+		return nil, fmt.Errorf("alert template %q: can't be a composite", d.Name)
+	}
+	if !strings.Contains(d.Name, "{{") {
+		return nil, fmt.Errorf("alert template %q: Name must be templated or every alert would have the same name", d.Name)
+	}
+	metric := d.Metric
+	if metric == "" {
+		metric = "{{.Path}}"
+	}
+	e := &alertExpansion{data: d, labels: make(map[string]*template.Template), generated: make(map[string]bool)}
+	var err error
+	parse := func(field, text string) *template.Template {
+		if err != nil {
+			return nil
+		}
+		var t *template.Template
+		t, err = template.New(field).Option("missingkey=error").Parse(text)
+		if err != nil {
+			err = fmt.Errorf("alert template %q: %s: %v", d.Name, field, err)
+		}
+		return t
+	}
+	e.name = parse("Name", d.Name)
+	e.metric = parse("Metric", metric)
+	e.runBookLink = parse("RunBookLink", d.RunBookLink)
+	for k, v := range d.Labels {
+		e.labels[k] = parse("Labels."+k, v)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// try it on the wildcard itself, so mistakes like {{.Nmae}} show up
+	// at startup rather than whenever graphite next answers
+	if _, err = e.alertData(newExpandMatch(d.Expand, d.Expand)); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// alertData is the concrete alert for one matched series.
+func (e *alertExpansion) alertData(m expandMatch) (alertData, error) {
+	d := e.data
+	d.Expand = ""
+	d.ExpandedFrom = e.data.Name
+	var err error
+	render := func(t *template.Template) string {
+		if err != nil {
+			return ""
+		}
+		var b bytes.Buffer
+		if err = t.Execute(&b, m); err != nil {
+			err = fmt.Errorf("alert template %q: %v", e.data.Name, err)
+		}
+		return b.String()
+	}
+	d.Name = render(e.name)
+	d.Metric = render(e.metric)
+	d.RunBookLink = render(e.runBookLink)
+	if len(e.labels) > 0 {
+		d.Labels = make(map[string]string, len(e.labels))
+		for k, t := range e.labels {
+			d.Labels[k] = render(t)
+		}
+	}
+	if err == nil && d.Name == "" {
+		err = fmt.Errorf("alert template %q: empty name for %s", e.data.Name, m.Path)
+	}
+	return d, err
+}
+
+// Expand finds the series matching the wildcard and returns an alert
+// for each, in order of name.
+func (e *alertExpansion) Expand(g graphiteFinder) ([]alertData, error) {
+	paths, err := g.find(e.data.Expand)
+	if err != nil {
+		return nil, fmt.Errorf("alert template %q: %v", e.data.Name, err)
+	}
+	seen := make(map[string]string)
+	var alerts []alertData
+	for _, p := range paths {
+		d, err := e.alertData(newExpandMatch(e.data.Expand, p))
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := seen[d.Name]; ok {
+			return nil, fmt.Errorf("alert template %q: %s and %s both make an alert called %q",
+				e.data.Name, other, p, d.Name)
+		}
+		seen[d.Name] = p
+		alerts = append(alerts, d)
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].Name < alerts[j].Name })
+	return alerts, nil
+}
+
+// findResult is one entry in graphite's treejson reply to /metrics/find.
+type findResult struct {
+	ID   string          `json:"id"`
+	Leaf json.RawMessage `json:"leaf"`
+}
+
+// isLeaf copes with graphite's 0/1 as well as true/false.
+func (r findResult) isLeaf() bool {
+	s := strings.Trim(string(r.Leaf), `"`)
+	return s == "1" || s == "true"
+}
+
+// find asks graphite which series match pattern. Branches are left
+// out; only series with data can be alerted on.
+func (g graphiteFinder) find(pattern string) ([]string, error) {
+	if g.base == "" {
+		return nil, fmt.Errorf("no graphite find URL; set HOUND_GRAPHITE_FIND_URL")
+	}
+	resp, err := g.fetcher.Get(g.base + "?query=" + url.QueryEscape(pattern) + "&format=treejson")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("graphite find returned %s", resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var results []findResult
+	if err = json.Unmarshal(b, &results); err != nil {
+		return nil, fmt.Errorf("graphite find: %v", err)
+	}
+	var paths []string
+	for _, r := range results {
+		if r.isLeaf() {
+			paths = append(paths, r.ID)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// defaultFindBase guesses the /metrics/find URL from the render URL.
+func defaultFindBase(render string) string {
+	u, err := url.Parse(render)
+	if err != nil {
+		return ""
+	}
+	p := strings.TrimSuffix(u.Path, "/")
+	if !strings.HasSuffix(p, "/render") && p != "render" {
+		return ""
+	}
+	u.Path = strings.TrimSuffix(p, "render") + "metrics/find/"
+	u.RawQuery = ""
+	return u.String()
+}
+
+// expandAlerts splits templated alerts out of the config, returning the
+// concrete alerts, with each template's expansion in its place, and the
+// templates themselves for expanding again later. A template graphite
+// can't be asked about yet just has no alerts until the next try.
+func expandAlerts(alerts []alertData, g graphiteFinder) ([]alertData, []*alertExpansion, error) {
+	static := make(map[string]bool)
+	for _, d := range alerts {
+		if d.Expand == "" {
+			static[d.Name] = true
+		}
+	}
+	var concrete []alertData
+	var expansions []*alertExpansion
+	for _, d := range alerts {
+		if d.Expand == "" {
+			concrete = append(concrete, d)
+			continue
+		}
+		e, err := newAlertExpansion(d)
+		if err != nil {
+			return nil, nil, err
+		}
+		expansions = append(expansions, e)
+		generated, err := e.Expand(g)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": fmt.Sprintf("%v", err),
+			}).Error("couldn't expand alert template")
+			continue
+		}
+		for _, g := range generated {
+			if static[g.Name] {
+				log.WithFields(log.Fields{
+					"template": d.Name,
+					"alert":    g.Name,
+				}).Error("alert template makes an alert with the same name as another")
+				continue
+			}
+			e.generated[g.Name] = true
+			concrete = append(concrete, g)
+		}
+	}
+	return concrete, expansions, nil
+}
+
+// refreshExpansions expands every template again, adding alerts for new
+// series and dropping the ones whose series have gone. Alerts that are
+// still there keep their state.
+func (ac *alertsCollection) refreshExpansions(now time.Time) {
+	ac.nextExpand = now.Add(ac.expandInterval)
+	for _, e := range ac.expansions {
+		generated, err := e.Expand(ac.finder)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": fmt.Sprintf("%v", err),
+			}).Error("couldn't expand alert template")
+			continue
+		}
+		current := make(map[string]bool, len(generated))
+		for _, d := range generated {
+			current[d.Name] = true
+			if existing := ac.byName(d.Name); existing != nil {
+				if !e.generated[d.Name] {
+					log.WithFields(log.Fields{
+						"template": e.data.Name,
+						"alert":    d.Name,
+					}).Error("alert template makes an alert with the same name as another")
+					delete(current, d.Name)
+					continue
+				}
+				if existing.Metric == cleanMetric(d.Metric) {
+					continue
+				}
+			}
+			a, err := ac.builder.build(d)
+			if err == nil {
+				err = ac.linkDependencies(a, d)
+			}
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error": fmt.Sprintf("%v", err),
+				}).Error("couldn't add alert from template")
+				delete(current, d.Name)
+				continue
+			}
+			a.NextCheck = now
+			ac.definitions[d.Name] = d
+			if existing := ac.byName(d.Name); existing != nil {
+				// keep its place in composites and with its dependents
+				ac.replaceAlert(existing, a)
+				log.WithFields(log.Fields{
+					"template": e.data.Name,
+					"alert":    d.Name,
+				}).Info("replaced alert whose series changed")
+				continue
+			}
+			ac.addAlert(a)
+			log.WithFields(log.Fields{
+				"template": e.data.Name,
+				"alert":    d.Name,
+			}).Info("added alert for new series")
+		}
+		for name := range e.generated {
+			if current[name] {
+				continue
+			}
+			if a := ac.byName(name); a != nil {
+				ac.removeAlert(a)
+				delete(ac.definitions, name)
+				log.WithFields(log.Fields{
+					"template": e.data.Name,
+					"alert":    name,
+				}).Info("removed alert for series that has gone")
+			}
+		}
+		e.generated = current
+	}
+}
+
+// expandDue says whether it's time to expand the templates again.
+func (ac *alertsCollection) expandDue(now time.Time) bool {
+	return len(ac.expansions) > 0 && !now.Before(ac.nextExpand)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// findFetcher answers /metrics/find with whatever series match, the
+// way graphite's treejson does.
+type findFetcher struct {
+	series []string
+	query  string
+}
+
+func (f *findFetcher) Get(u string) (*http.Response, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	f.query = parsed.Query().Get("query")
+	var entries []string
+	for _, s := range f.series {
+		entries = append(entries, fmt.Sprintf(`{"id": %q, "text": "x", "leaf": 1}`, s))
+	}
+	entries = append(entries, `{"id": "app.smoketest.branch", "leaf": 0}`)
+	body := "[" + strings.Join(entries, ",") + "]"
+	return &http.Response{StatusCode: 200, Status: "200 OK",
+		Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+}
+
+func Test_expandMatch(t *testing.T) {
+	m := newExpandMatch("app.*.{prod,stage}.failed", "app.capsim.prod.failed")
+	if m.Node(1) != "capsim" || m.Node(-1) != "failed" || m.Node(9) != "" {
+		t.Errorf("wrong nodes: %q %q %q", m.Node(1), m.Node(-1), m.Node(9))
+	}
+	if m.Match(0) != "capsim" || m.Match(1) != "prod" || m.Match(2) != "" {
+		t.Errorf("wrong matches: %q %q %q", m.Match(0), m.Match(1), m.Match(2))
+	}
+}
+
+func Test_expandAlerts(t *testing.T) {
+	f := &findFetcher{series: []string{"app.smoketest.mvsim.failed", "app.smoketest.capsim.failed"}}
+	g := graphiteFinder{base: "http://graphite.example.com/metrics/find/", fetcher: f}
+	alerts, expansions, err := expandAlerts([]alertData{
+		{Name: "static", Metric: "foo"},
+		{
+			Name:        "{{.Match 0}} smoketests",
+			Expand:      "app.smoketest.*.failed",
+			Metric:      "sumSeries({{.Path}})",
+			RunBookLink: "https://wiki.example.com/{{.Node 2}}",
+			Labels:      map[string]string{"app": "{{.Match 0}}", "team": "ops"},
+			Threshold:   1,
+		},
+	}, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.query != "app.smoketest.*.failed" {
+		t.Errorf("asked graphite about %q", f.query)
+	}
+	if len(expansions) != 1 || len(alerts) != 3 {
+		t.Fatalf("expected 3 alerts from 1 template, got %d from %d", len(alerts), len(expansions))
+	}
+	a := alerts[1]
+	if a.Name != "capsim smoketests" || a.Metric != "sumSeries(app.smoketest.capsim.failed)" ||
+		a.RunBookLink != "https://wiki.example.com/capsim" || a.Threshold != 1 {
+		t.Errorf("wrong alert: %+v", a)
+	}
+	if a.Labels["app"] != "capsim" || a.Labels["team"] != "ops" {
+		t.Errorf("wrong labels: %v", a.Labels)
+	}
+	if a.Expand != "" || a.ExpandedFrom != "{{.Match 0}} smoketests" {
+		t.Errorf("expanded alert should say where it came from: %+v", a)
+	}
+	if alerts[2].Name != "mvsim smoketests" {
+		t.Errorf("expected alerts in order, got %s", alerts[2].Name)
+	}
+}
+
+func Test_expandAlertsErrors(t *testing.T) {
+	f := &findFetcher{series: []string{"a.x.b", "a.y.b"}}
+	g := graphiteFinder{base: "http://graphite.example.com/metrics/find/", fetcher: f}
+	for _, d := range []alertData{
+		{Name: "same name", Expand: "a.*.b"},
+		{Name: "{{.Nope}}", Expand: "a.*.b"},
+		{Name: "{{.Match 0", Expand: "a.*.b"},
+		{Name: "{{.Match 0}}", Expand: "a.*.b", Children: []string{"c"}},
+	} {
+		if _, _, err := expandAlerts([]alertData{d}, g); err == nil {
+			t.Errorf("expected an error for %q", d.Name)
+		}
+	}
+
+	// two series making the same name is left for the next expansion
+	alerts, _, err := expandAlerts([]alertData{{Name: "{{.Node 0}}", Expand: "a.*.b"}}, g)
+	if err != nil || len(alerts) != 0 {
+		t.Errorf("expected no alerts and no error, got %v, %v", alerts, err)
+	}
+}
+
+func Test_refreshExpansions(t *testing.T) {
+	f := &findFetcher{series: []string{"app.a.failed", "app.b.failed"}}
+	g := graphiteFinder{base: "http://graphite.example.com/metrics/find/", fetcher: f}
+	alerts, expansions, err := expandAlerts([]alertData{
+		{Name: "parent", Metric: "parent"},
+		{Name: "{{.Match 0}} failed", Expand: "app.*.failed", DependsOn: []string{"parent"}},
+	}, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac := newAlertsCollection(DummyEmailer{})
+	ac.builder = &alertBuilder{c: config{EmailTo: "ops@example.com"}, templates: newAlertTemplateCache(baseNotificationTemplates)}
+	ac.expansions = expansions
+	ac.finder = g
+	for _, d := range alerts {
+		a, err := ac.builder.build(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ac.addAlert(a)
+	}
+	for i, d := range alerts {
+		if err := ac.linkDependencies(ac.alerts[i], d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := ac.byName("b failed")
+	b.Status = "Failed"
+
+	now := time.Now()
+	f.series = []string{"app.b.failed", "app.c.failed"}
+	ac.refreshExpansions(now)
+	if ac.byName("a failed") != nil {
+		t.Error("alert for a series that's gone should have been removed")
+	}
+	if ac.byName("b failed") != b || b.Status != "Failed" {
+		t.Error("alert for a series that's still there should be kept as it was")
+	}
+	c := ac.byName("c failed")
+	if c == nil {
+		t.Fatal("expected an alert for the new series")
+	}
+	if c.Metric != "app.c.failed" || c.EmailTo != "ops@example.com" || c.ExpandedFrom != "{{.Match 0}} failed" {
+		t.Errorf("wrong new alert: %+v", c)
+	}
+	if len(c.Parents) != 1 || c.Parents[0] != ac.byName("parent") {
+		t.Error("new alert should depend on its parent")
+	}
+	if !c.Due(now) {
+		t.Error("new alert should be checked right away")
+	}
+	if len(ac.alerts) != 3 {
+		t.Errorf("expected 3 alerts, got %d", len(ac.alerts))
+	}
+	if !ac.nextExpand.After(now) || ac.expandDue(now) {
+		t.Error("next expansion should be later")
+	}
+}
+
+func Test_refreshExpansionsRelinks(t *testing.T) {
+	f := &findFetcher{series: []string{"app.a.failed.v1"}}
+	g := graphiteFinder{base: "http://graphite.example.com/metrics/find/", fetcher: f}
+	defs := []alertData{
+		{Name: "{{.Match 0}} failed", Expand: "app.*.failed.*"},
+		{Name: "any failed", Children: []string{"a failed"}, Operator: "or", MuteChildren: true},
+		{Name: "downstream", Metric: "downstream", DependsOn: []string{"a failed"}},
+	}
+	alerts, expansions, err := expandAlerts(defs, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac := newAlertsCollection(DummyEmailer{})
+	ac.builder = &alertBuilder{c: config{EmailTo: "ops@example.com"}, templates: newAlertTemplateCache(baseNotificationTemplates)}
+	ac.expansions = expansions
+	ac.finder = g
+	for _, d := range alerts {
+		a, err := ac.builder.build(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ac.addAlert(a)
+	}
+	for i, d := range alerts {
+		if len(d.Children) > 0 {
+			if err := ac.linkComposite(ac.alerts[i], d); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := ac.linkDependencies(ac.alerts[i], d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	composite, downstream := ac.byName("any failed"), ac.byName("downstream")
+
+	// the same name for a different series replaces the alert in place
+	f.series = []string{"app.a.failed.v2"}
+	ac.refreshExpansions(time.Now())
+	a := ac.byName("a failed")
+	if a.Metric != "app.a.failed.v2" || !a.Muted {
+		t.Errorf("wrong replacement: %+v", a)
+	}
+	if len(composite.Children) != 1 || composite.Children[0] != a {
+		t.Error("replacement should be the composite's child")
+	}
+	if len(downstream.Parents) != 1 || downstream.Parents[0] != a {
+		t.Error("replacement should be the dependent's parent")
+	}
+
+	// a composite whose children have all gone is still a composite
+	f.series = nil
+	ac.refreshExpansions(time.Now())
+	if !composite.IsComposite() || len(composite.Children) != 0 {
+		t.Fatal("composite should have no children but still be one")
+	}
+	if ac.byHash(composite.Hash()) != composite {
+		t.Error("composite should be found under its new hash")
+	}
+	composite.evaluateComposite()
+	if composite.Status != "Error" {
+		t.Errorf("composite with no children should error, got %s", composite.Status)
+	}
+}
+
+func Test_defaultFindBase(t *testing.T) {
+	for render, find := range map[string]string{
+		"https://graphite.example.com/render/":    "https://graphite.example.com/metrics/find/",
+		"https://graphite.example.com/g/render":   "https://graphite.example.com/g/metrics/find/",
+		"https://graphite.example.com/somewhere/": "",
+	} {
+		if got := defaultFindBase(render); got != find {
+			t.Errorf("%s: expected %q, got %q", render, find, got)
+		}
+	}
+}
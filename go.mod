@@ -3,6 +3,8 @@ module github.com/ccnmtl/hound
 go 1.15
 
 require (
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/kelseyhightower/envconfig v1.4.0
 	github.com/sirupsen/logrus v1.9.4
+	gopkg.in/yaml.v3 v3.0.1
 )
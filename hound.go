@@ -2,12 +2,10 @@ package main // import "github.com/ccnmtl/hound"
 
 import (
 	"context"
-	"encoding/json"
 	"expvar"
 	"flag"
 	"fmt"
 	"html/template"
-	"io/ioutil"
 	"net/http"
 	"os"
 	"os/signal"
@@ -16,7 +14,6 @@ import (
 	"time"
 
 	log "github.com/sirupsen/logrus"
-	"github.com/kelseyhightower/envconfig"
 )
 
 var (
@@ -32,10 +29,6 @@ var (
 	globalBackoff             int
 	lastErrorEmail            time.Time
 	emailOnError              bool
-	smtpServer                string
-	smtpPort                  int
-	smtpUser                  string
-	smtpPassword              string
 	window                    string
 )
 
@@ -51,7 +44,9 @@ var (
 type config struct {
 	GraphiteBase              string `envconfig:"GRAPHITE_BASE"`
 	GraphiteBasicAuthUser     string `envconfig:"GRAPHITE_BASIC_AUTH_USER"`
-	GraphiteBasicAuthPassword string `envconfig:"GRAPHITE_BASIC_AUTH_PASSWORD"`
+	GraphiteBasicAuthPassword string `envconfig:"GRAPHITE_BASIC_AUTH_PASSWORD" secret:"true"`
+	GraphiteFindURL           string `envconfig:"GRAPHITE_FIND_URL"`
+	ExpandInterval            int    `envconfig:"EXPAND_INTERVAL"`
 	CarbonBase                string `envconfig:"CARBON_BASE"`
 	MetricBase                string `envconfig:"METRIC_BASE"`
 	EmailFrom                 string `envconfig:"EMAIL_FROM"`
@@ -61,74 +56,75 @@ type config struct {
 	HTTPPort                  string `envconfig:"HTTP_PORT"`
 	TemplateFile              string `envconfig:"TEMPLATE_FILE"`
 	AlertTemplateFile         string `envconfig:"ALERT_TEMPLATE_FILE"`
+	EmailTemplateFile         string `envconfig:"EMAIL_TEMPLATE_FILE"`
+	NotificationTemplates     string `envconfig:"NOTIFICATION_TEMPLATES"`
+	DashboardURL              string `envconfig:"DASHBOARD_URL"`
 	EmailOnError              bool   `envconfig:"EMAIL_ON_ERROR"`
 	SMTPServer                string `envconfig:"SMTP_SERVER"`
 	SMTPPort                  int    `envconfig:"SMTP_PORT"`
 	SMTPUser                  string `envconfig:"SMTP_USER"`
-	SMTPPassword              string `envconfig:"SMTP_PASSWORD"`
+	SMTPPassword              string `envconfig:"SMTP_PASSWORD" secret:"true"`
+	SMTPTLSMode               string `envconfig:"SMTP_TLS_MODE"`
+	SMTPServerName            string `envconfig:"SMTP_SERVER_NAME"`
+	SMTPCAFile                string `envconfig:"SMTP_CA_FILE"`
+	SMTPInsecureSkipVerify    bool   `envconfig:"SMTP_INSECURE_SKIP_VERIFY"`
+	SMTPClientCert            string `envconfig:"SMTP_CLIENT_CERT"`
+	SMTPClientKey             string `envconfig:"SMTP_CLIENT_KEY"`
+	SMTPAuth                  string `envconfig:"SMTP_AUTH"`
+	SMTPTimeout               int    `envconfig:"SMTP_TIMEOUT"`
+	Digest                    bool   `envconfig:"DIGEST"`
+	DigestWindow              int    `envconfig:"DIGEST_WINDOW"`
+	ReportSchedule            string `envconfig:"REPORT_SCHEDULE"`
+	ReportTo                  string `envconfig:"REPORT_TO"`
+	EscalationFile            string `envconfig:"ESCALATION_FILE" restart:"true"`
+	QueueFile                 string `envconfig:"QUEUE_FILE" restart:"true"`
+	QueueMaxAttempts          int    `envconfig:"QUEUE_MAX_ATTEMPTS" restart:"true"`
 	LogLevel                  string `envconfig:"LOG_LEVEL"`
 	ReadTimeout               int    `envconfig:"READ_TIMEOUT"`
 	WriteTimeout              int    `envconfig:"WRITE_TIMEOUT"`
 	Window                    string `envconfig:"WINDOW"`
+	WatchConfig               bool   `envconfig:"WATCH_CONFIG" restart:"true"`
+	WatchPollInterval         int    `envconfig:"WATCH_POLL_INTERVAL" restart:"true"`
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(runCheck(os.Args[2:]))
+	}
 	log.SetLevel(log.InfoLevel)
 	// read the config file
 	var configfile string
-	flag.StringVar(&configfile, "config", "./config.json", "JSON config file")
+	flag.StringVar(&configfile, "config", "./config.json", "JSON or YAML config file, directory or glob")
 	flag.Parse()
 
-	var c config
-	err := envconfig.Process("hound", &c)
+	log.AddHook(redactHook{})
+	f := loadConfig(configfile)
+	c, err := loadSettings(f)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
-
-	// defaults to INFO
-	if c.LogLevel == "DEBUG" {
-		log.SetLevel(log.DebugLevel)
-	}
-	if c.LogLevel == "WARN" {
-		log.SetLevel(log.WarnLevel)
-	}
-	if c.LogLevel == "ERROR" {
-		log.SetLevel(log.ErrorLevel)
-	}
-	if c.LogLevel == "FATAL" {
-		log.SetLevel(log.FatalLevel)
+	if err = applySettings(c); err != nil {
+		log.Fatal(err.Error())
 	}
 
 	log.Info("running on ", c.HTTPPort)
-	// set global values
-	graphiteBase = c.GraphiteBase
-	graphiteBasicAuthUser = c.GraphiteBasicAuthUser
-	graphiteBasicAuthPassword = c.GraphiteBasicAuthPassword
-	carbonBase = c.CarbonBase
-	metricBase = c.MetricBase
-	emailFrom = c.EmailFrom
-	emailTo = c.EmailTo
-	checkInterval = c.CheckInterval
-	globalThrottle = c.GlobalThrottle
 	globalBackoff = 0
-	emailOnError = c.EmailOnError
-	smtpServer = c.SMTPServer
-	smtpPort = c.SMTPPort
-	smtpUser = c.SMTPUser
-	smtpPassword = c.SMTPPassword
-	window = c.Window
-
-	// some defaults
-	if c.ReadTimeout == 0 {
-		c.ReadTimeout = 5
+	if c.QueueFile == "" {
+		log.Warn("no HOUND_QUEUE_FILE, so queued notifications will be lost on a restart")
 	}
-	if c.WriteTimeout == 0 {
-		c.WriteTimeout = 10
+	outbox, err = newNotificationQueue(c.QueueFile, c.QueueMaxAttempts)
+	if err != nil {
+		log.Fatal(err.Error())
 	}
-	if window == "" {
-		window = "10mins"
+	// the outbox outlives config reloads, so nothing queued is lost
+	go outbox.Run(context.Background())
+	if c.EscalationFile == "" {
+		log.Warn("no HOUND_ESCALATION_FILE, so escalations will start over on a restart")
+	}
+	escalations, err = newEscalationStore(c.EscalationFile)
+	if err != nil {
+		log.Fatal(err.Error())
 	}
-
 	lastErrorEmail = time.Now()
 
 	go func() {
@@ -139,67 +135,127 @@ func main() {
 		}
 	}()
 
-	f := loadConfig(configfile)
-
+	ac, err := buildAlertsCollection(f, c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// alerts may have gone while hound wasn't running
+	escalations.prune(ac)
 	bgcontext := context.Background()
-	s, alertscancel := startServices(bgcontext, f, c)
+	s, alertscancel := startServices(bgcontext, ac, c)
 
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	changes := make(chan struct{}, 1)
+	if c.WatchConfig {
+		w := newConfigWatcher(configfile, time.Duration(c.WatchPollInterval)*time.Second)
+		go w.Run(bgcontext, changes)
+	}
 
 	for {
-		// wait for a signal
-		signal := <-sigs
-
-		// shut everything down nicely
-		// then gracefully shut everything down.
-		alertscancel()
-
-		// giving the http server 1 second to close its connections
-		ctx, cancel := context.WithTimeout(bgcontext, 1*time.Second)
-
-		if err = s.Shutdown(ctx); err != nil {
-			log.WithFields(
-				log.Fields{
-					"error": fmt.Sprintf("%v", err),
-				}).Fatal("graceful shutdown failed")
-		} else {
-			log.Info("successful graceful shutdown")
+		// wait for a signal or the config to change
+		select {
+		case signal := <-sigs:
+			if signal != syscall.SIGHUP {
+				// SIGINT or SIGTERM. We're done.
+				shutdownServer(bgcontext, s)
+				log.Info("exiting")
+				return
+			}
+		case <-changes:
+			log.Info("config changed")
 		}
-		cancel()
-		if signal == syscall.SIGHUP {
-			// reload config and restart services
-			f = loadConfig(configfile)
-			log.Info("re-read config")
-			s, alertscancel = startServices(bgcontext, f, c)
-			log.Info("restarted services")
-		} else {
-			// SIGINT or SIGTERM. We're done.
-			log.Info("exiting")
-			return
+
+		// check the new config before stopping anything, so a broken
+		// one leaves the old one running
+		nc, nac, apply, err := prepareReload(configfile, c)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": fmt.Sprintf("%v", err),
+			}).Error("config not reloaded")
+			continue
 		}
+		// nothing global changes until the old alerts have stopped
+		alertscancel()
+		shutdownServer(bgcontext, s)
+		apply()
+		nac.carryOver(ac)
+		logAlertChanges(ac, nac)
+		c, ac = nc, nac
+		log.Info("re-read config")
+		s, alertscancel = startServices(bgcontext, ac, c)
+		log.Info("restarted services")
 	}
 }
 
-func loadConfig(configfile string) configData {
-	file, err := ioutil.ReadFile(configfile)
+// prepareReload reads and checks the config file and settings again,
+// returning the new alerts and a function that puts the new settings
+// into effect, once the old alerts have stopped.
+func prepareReload(configfile string, old config) (config, *alertsCollection, func(), error) {
+	f, err := readConfig(configfile)
 	if err != nil {
-		log.Fatal(err)
+		return old, nil, nil, err
+	}
+	c, err := loadSettings(f)
+	if err != nil {
+		return old, nil, nil, err
 	}
+	c = c.reloaded(old)
+	apply, err := prepareSettings(c)
+	if err != nil {
+		return old, nil, nil, err
+	}
+	ac, err := buildAlertsCollection(f, c)
+	if err != nil {
+		return old, nil, nil, err
+	}
+	return c, ac, apply, nil
+}
+
+// shutdownServer gives the http server 1 second to close its
+// connections.
+func shutdownServer(ctx context.Context, s *http.Server) {
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		log.WithFields(
+			log.Fields{
+				"error": fmt.Sprintf("%v", err),
+			}).Fatal("graceful shutdown failed")
+	} else {
+		log.Info("successful graceful shutdown")
+	}
+}
 
-	f := configData{}
-	err = json.Unmarshal(file, &f)
+func loadConfig(configfile string) configData {
+	f, err := readConfig(configfile)
 	if err != nil {
 		log.Fatal(err)
 	}
 	return f
 }
 
+// defaultTemplateFile finds a template in the same location as index.html
+func defaultTemplateFile(indexFile, name string) string {
+	return strings.Replace(indexFile, "index", name, 1)
+}
+
 func registerHandlers(ac *alertsCollection, c config) *http.ServeMux {
+	alertTemplateFile := c.AlertTemplateFile
+	if alertTemplateFile == "" {
+		alertTemplateFile = defaultTemplateFile(c.TemplateFile, "alert")
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/",
 		func(w http.ResponseWriter, r *http.Request) {
+			matchers, err := parseLabelMatchers(r.URL.Query()["label"])
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 			pr := ac.MakePageResponse()
+			pr.filter(matchers)
 
 			t, err := template.ParseFiles(c.TemplateFile)
 			if err != nil {
@@ -212,43 +268,175 @@ func registerHandlers(ac *alertsCollection, c config) *http.ServeMux {
 
 	mux.HandleFunc("/alert/",
 		func(w http.ResponseWriter, r *http.Request) {
-			stringIdx := strings.Split(r.URL.String(), "/")[2]
-			pr := ac.MakeindivPageResponse(stringIdx)
-
-			if c.AlertTemplateFile == "" {
-				// default to same location as index.html
-				c.AlertTemplateFile = strings.Replace(c.TemplateFile, "index", "alert", 1)
+			parts := strings.Split(r.URL.Path, "/")
+			if len(parts) > 3 && parts[3] == "ack" {
+				acknowledgeHandler(ac, parts[2], w, r)
+				return
 			}
+			pr := ac.MakeindivPageResponse(parts[2], r.URL.Query().Get("ack"))
 
-			t, err := template.ParseFiles(c.AlertTemplateFile)
+			t, err := template.ParseFiles(alertTemplateFile)
 			if err != nil {
 				log.Fatal(fmt.Sprintf("%v", err))
 			}
 			t.Execute(w, pr)
 		})
+
+	mux.HandleFunc("/api/alerts",
+		func(w http.ResponseWriter, r *http.Request) {
+			alertsAPIHandler(ac, w, r)
+		})
 	return mux
 }
 
-func startAlertsCollection(ctx context.Context, f configData, c config) (*alertsCollection, context.CancelFunc) {
-	// initialize all the alerts
+// alertBuilder turns alert config into alerts. It's kept with the
+// collection so alert templates can add alerts after startup.
+type alertBuilder struct {
+	c         config
+	schedules map[string]*onCallSchedule
+	policies  map[string]*escalationPolicy
+	windows   []*notificationWindow
+	receivers map[string]receiver
+	route     *route
+	templates *alertTemplateCache
+}
+
+func (b *alertBuilder) build(a alertData) (*alert, error) {
+	if !evaluators[a.Evaluator] {
+		return nil, fmt.Errorf("%s: unknown evaluator %q", a.Name, a.Evaluator)
+	}
+	na := newAlert(a.Name, a.Metric, a.Type, a.Threshold, a.Direction, httpFetcher{}, a.EmailTo, a.RunBookLink)
+	na.Labels = a.Labels
+	na.Evaluator = a.Evaluator
+	na.BaselineWindow = a.BaselineWindow
+	na.CheckInterval = time.Duration(a.CheckInterval) * time.Minute
+	na.Window = a.Window
+	na.EmailCc = a.EmailCc
+	na.EmailBcc = a.EmailBcc
+	na.ExpandedFrom = a.ExpandedFrom
+	na.Source = a.Source
+	routeAlert(na, b.route, b.receivers)
+	if na.EmailTo == "" {
+		na.EmailTo = b.c.EmailTo
+	}
+	if err := checkOnCallReferences(b.schedules, na.EmailTo, na.EmailCc, na.EmailBcc); err != nil {
+		return nil, fmt.Errorf("%s: %v", a.Name, err)
+	}
+	var err error
+	na.NotifyWindow, err = windowFor(b.windows, a.NotificationWindow, na.Type)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", a.Name, err)
+	}
+	if a.Escalation != "" {
+		na.Escalation = b.policies[a.Escalation]
+		if na.Escalation == nil {
+			return nil, fmt.Errorf("%s: unknown escalation policy %s", a.Name, a.Escalation)
+		}
+	}
+	if a.Templates != "" {
+		t, err := b.templates.load(a.Templates)
+		if err != nil {
+			return nil, err
+		}
+		na.templates = t
+	}
+	return na, nil
+}
+
+// buildAlertsCollection sets up every alert in f with the settings in c,
+// without starting them or changing anything global, so a config that's
+// been changed can be checked while the old one carries on running.
+func buildAlertsCollection(f configData, c config) (*alertsCollection, error) {
 	ac := newAlertsCollection(smtpEmailer{})
-	for _, a := range f.Alerts {
-		emailTo := a.EmailTo
-		if emailTo == "" {
-			emailTo = c.EmailTo
+	var err error
+	if ac.schedules, err = loadOnCallSchedules(f); err != nil {
+		return nil, err
+	}
+	if err = checkOnCallReferences(ac.schedules, c.EmailTo, c.ReportTo); err != nil {
+		return nil, err
+	}
+	policies, err := loadEscalationPolicies(f, ac.schedules)
+	if err != nil {
+		return nil, err
+	}
+	ac.windows, err = loadNotificationWindows(f)
+	if err != nil {
+		return nil, err
+	}
+	receivers, err := loadReceivers(f, ac.schedules)
+	if err != nil {
+		return nil, err
+	}
+	base, err := c.notificationTemplates()
+	if err != nil {
+		return nil, err
+	}
+	b := &alertBuilder{c: c, schedules: ac.schedules, policies: policies, windows: ac.windows,
+		receivers: receivers, templates: newAlertTemplateCache(base)}
+	if f.Route != nil {
+		if b.route, err = newRoute(*f.Route, receivers, ""); err != nil {
+			return nil, err
 		}
-		ac.addAlert(newAlert(a.Name, a.Metric, a.Type, a.Threshold, a.Direction, httpFetcher{}, emailTo, a.RunBookLink))
 	}
-	alertsctx, alertscancel := context.WithCancel(ctx)
+	ac.builder = b
+	ac.finder = c.finder()
+	alerts, expansions, err := expandAlerts(f.Alerts, ac.finder)
+	if err != nil {
+		return nil, err
+	}
+	ac.expansions = expansions
+	ac.expandInterval = time.Duration(c.ExpandInterval) * time.Minute
+	ac.nextExpand = time.Now().Add(ac.expandInterval)
+	for _, a := range alerts {
+		na, err := b.build(a)
+		if err != nil {
+			return nil, err
+		}
+		ac.addAlert(na)
+		ac.definitions[a.Name] = a
+	}
+	// composites can only be linked up once every alert they might
+	// refer to has been added
+	for i, a := range alerts {
+		if len(a.Children) == 0 {
+			continue
+		}
+		if err = ac.linkComposite(ac.alerts[i], a); err != nil {
+			return nil, err
+		}
+	}
+	for i, a := range alerts {
+		if err = ac.linkDependencies(ac.alerts[i], a); err != nil {
+			return nil, err
+		}
+	}
+	if err = ac.checkDependencyCycles(); err != nil {
+		return nil, err
+	}
+	return ac, nil
+}
 
-	// kick off alerts in the background
-	go ac.Run(alertsctx)
+// startAlertsCollection kicks off the alerts in the background. The
+// CancelFunc it returns waits for the checks in progress to finish, so
+// nothing changes once it has returned.
+func startAlertsCollection(ctx context.Context, ac *alertsCollection) context.CancelFunc {
+	onCallSchedules = ac.schedules
+	ac.publish()
+	alertsctx, alertscancel := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	go func() {
+		ac.Run(alertsctx)
+		close(stopped)
+	}()
 
-	return ac, alertscancel
+	return func() {
+		alertscancel()
+		<-stopped
+	}
 }
 
-func startServices(ctx context.Context, f configData, c config) (*http.Server, context.CancelFunc) {
-	ac, alertscancel := startAlertsCollection(ctx, f, c)
+func startServices(ctx context.Context, ac *alertsCollection, c config) (*http.Server, context.CancelFunc) {
+	alertscancel := startAlertsCollection(ctx, ac)
 	mux := registerHandlers(ac, c)
 	s := &http.Server{
 		Addr:         ":" + c.HTTPPort,
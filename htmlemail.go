@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// emailTemplate renders the HTML part of alert emails. If it's nil,
+// alerts go out as plain text only.
+var emailTemplate *template.Template
+
+type htmlEmailData struct {
+	Alert       *alert
+	DailyGraph  template.URL
+	WeeklyGraph template.URL
+}
+
+// loadEmailTemplate parses the HTML email template. An explicitly
+// configured template that can't be parsed is fatal; the default one
+// next to index.html is optional.
+func loadEmailTemplate(c config) *template.Template {
+	if c.EmailTemplateFile != "" {
+		t, err := template.ParseFiles(c.EmailTemplateFile)
+		if err != nil {
+			log.Fatal(fmt.Sprintf("%v", err))
+		}
+		return t
+	}
+	defaultFile := defaultTemplateFile(c.TemplateFile, "email")
+	if _, err := os.Stat(defaultFile); err != nil {
+		log.WithFields(log.Fields{
+			"file": defaultFile,
+		}).Info("no HTML email template, sending plain text alerts")
+		return nil
+	}
+	t, err := template.ParseFiles(defaultFile)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": fmt.Sprintf("%v", err),
+		}).Error("error parsing HTML email template, sending plain text alerts")
+		return nil
+	}
+	return t
+}
+
+// graphFetcher fetches the graphs in HTML emails as they're sent.
+var graphFetcher fetcher = httpFetcher{}
+
+// inlineGraph attaches the graph at url under the given content ID and
+// returns the URL the HTML should use for it. The graph itself is only
+// fetched when the message is sent, so checking doesn't wait on graphite
+// and the queue doesn't fill up with images.
+func inlineGraph(m *mailMessage, url, cid string) template.URL {
+	m.Inline = append(m.Inline, inlineImage{ContentID: cid, URL: url})
+	return template.URL("cid:" + cid)
+}
+
+// fetchGraph pulls a rendered graph from graphite so it can be attached
+// to the email rather than linked.
+func fetchGraph(url string) ([]byte, string, error) {
+	resp, err := graphFetcher.Get(url)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.Status != "200 OK" {
+		return nil, "", errors.New("graphite did not return 200 OK")
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "image/png"
+	}
+	return b, contentType, nil
+}
+
+// withGraphs fetches the graphs m's HTML refers to. If graphite can't
+// supply one, the HTML just links to graphite instead.
+func (m mailMessage) withGraphs() mailMessage {
+	var inline []inlineImage
+	for _, img := range m.Inline {
+		if img.URL == "" || img.Data != nil {
+			inline = append(inline, img)
+			continue
+		}
+		data, contentType, err := fetchGraph(img.URL)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"subject": m.Subject,
+				"error":   fmt.Sprintf("%v", err),
+			}).Warn("couldn't fetch graph for email")
+			m.HTML = strings.Replace(m.HTML, "cid:"+img.ContentID, template.HTMLEscapeString(img.URL), -1)
+			continue
+		}
+		img.ContentType, img.Data = contentType, data
+		inline = append(inline, img)
+	}
+	m.Inline = inline
+	return m
+}
+
+func (a *alert) alertEmailMessage() mailMessage {
+	m := mailMessage{From: emailFrom, To: a.EmailTo, Cc: a.EmailCc, Bcc: a.EmailBcc,
+		Subject: a.alertEmailSubject(), Text: a.alertEmailBody()}
+	if emailTemplate == nil {
+		return m
+	}
+	data := htmlEmailData{Alert: a}
+	if !a.IsComposite() {
+		data.DailyGraph = inlineGraph(&m, a.DailyGraphURL(), "daily-"+a.Hash()+"@hound")
+		data.WeeklyGraph = inlineGraph(&m, a.WeeklyGraphURL(), "weekly-"+a.Hash()+"@hound")
+	}
+	var html bytes.Buffer
+	if err := emailTemplate.Execute(&html, data); err != nil {
+		log.WithFields(log.Fields{
+			"name":  a.Name,
+			"error": fmt.Sprintf("%v", err),
+		}).Error("error rendering HTML email, sending plain text")
+		m.Inline = nil
+		return m
+	}
+	m.HTML = html.String()
+	return m
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"html/template"
+	"strings"
+	"testing"
+)
+
+func Test_alertEmailMessagePlain(t *testing.T) {
+	emailTemplate = nil
+	a := newAlert("foo", "foo", "", 10, "above", DummyFetcher{}, "test@example.com", "")
+	m := a.alertEmailMessage()
+	if m.HTML != "" || m.Text != a.alertEmailBody() {
+		t.Error("expected a plain text message without a template")
+	}
+}
+
+func Test_alertEmailMessageHTML(t *testing.T) {
+	emailTemplate = template.Must(template.ParseFiles("email.html"))
+	defer func() { emailTemplate = nil }()
+	defer func() { graphFetcher = httpFetcher{} }()
+	graphFetcher = BodyFetcher{"from=-24hours": "daily png"}
+
+	a := newAlert("foo", "foo", "", 10, "above", DummyFetcher{}, "test@example.com", "")
+	m := a.alertEmailMessage()
+	if m.Text != a.alertEmailBody() {
+		t.Error("the plain text part should be kept")
+	}
+	if len(m.Inline) != 2 || m.Inline[0].Data != nil || m.Inline[0].URL != a.DailyGraphURL() {
+		t.Fatal("the graphs should be queued by URL, not fetched", m.Inline)
+	}
+
+	m = m.withGraphs()
+	if len(m.Inline) != 1 || string(m.Inline[0].Data) != "daily png" {
+		t.Fatal("expected the daily graph inline", m.Inline)
+	}
+	if !strings.Contains(m.HTML, "cid:"+m.Inline[0].ContentID) {
+		t.Error("html should refer to the inline daily graph")
+	}
+	if strings.Contains(m.HTML, "cid:weekly") || !strings.Contains(m.HTML, "from=-7days") {
+		t.Error("html should link to the weekly graph it couldn't fetch")
+	}
+}
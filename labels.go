@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Alerts without their own EmailTo are routed by their labels, through
+// a tree of routes like Alertmanager's, to receivers. That's worked out
+// once, when the config is loaded.
+
+type receiver struct {
+	EmailTo  string
+	EmailCc  string
+	EmailBcc string
+}
+
+type route struct {
+	match    map[string]string
+	matchRE  map[string]*regexp.Regexp
+	receiver string
+	cont     bool
+	routes   []*route
+}
+
+func loadReceivers(f configData, schedules map[string]*onCallSchedule) (map[string]receiver, error) {
+	receivers := make(map[string]receiver)
+	for _, d := range f.Receivers {
+		if d.Name == "" {
+			return nil, fmt.Errorf("receiver without a name")
+		}
+		if _, ok := receivers[d.Name]; ok {
+			return nil, fmt.Errorf("duplicate receiver %s", d.Name)
+		}
+		if err := checkOnCallReferences(schedules, d.EmailTo, d.EmailCc, d.EmailBcc); err != nil {
+			return nil, fmt.Errorf("receiver %s: %v", d.Name, err)
+		}
+		receivers[d.Name] = receiver{EmailTo: d.EmailTo, EmailCc: d.EmailCc, EmailBcc: d.EmailBcc}
+	}
+	return receivers, nil
+}
+
+// newRoute compiles a routing tree, checking every receiver it names
+// exists. A route without a Receiver uses its parent's.
+func newRoute(d routeData, receivers map[string]receiver, parent string) (*route, error) {
+	r := &route{match: d.Match, matchRE: make(map[string]*regexp.Regexp),
+		receiver: d.Receiver, cont: d.Continue}
+	if r.receiver == "" {
+		r.receiver = parent
+	}
+	if r.receiver != "" {
+		if _, ok := receivers[r.receiver]; !ok {
+			return nil, fmt.Errorf("route to unknown receiver %s", r.receiver)
+		}
+	}
+	for label, expr := range d.MatchRE {
+		// anchored, like Alertmanager
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("route MatchRE %s: %v", label, err)
+		}
+		r.matchRE[label] = re
+	}
+	for _, child := range d.Routes {
+		c, err := newRoute(child, receivers, r.receiver)
+		if err != nil {
+			return nil, err
+		}
+		r.routes = append(r.routes, c)
+	}
+	return r, nil
+}
+
+func (r *route) matches(labels map[string]string) bool {
+	for k, v := range r.match {
+		if labels[k] != v {
+			return false
+		}
+	}
+	for k, re := range r.matchRE {
+		if !re.MatchString(labels[k]) {
+			return false
+		}
+	}
+	return true
+}
+
+// receivers is where an alert with labels that matches r ends up.
+func (r *route) receivers(labels map[string]string) []string {
+	var found []string
+	for _, c := range r.routes {
+		if !c.matches(labels) {
+			continue
+		}
+		found = append(found, c.receivers(labels)...)
+		if !c.cont {
+			break
+		}
+	}
+	if len(found) == 0 && r.receiver != "" {
+		found = []string{r.receiver}
+	}
+	return found
+}
+
+// routeAlert fills in an alert's recipients from the routing tree, if
+// it doesn't name its own. It says whether a route applied.
+func routeAlert(a *alert, root *route, receivers map[string]receiver) bool {
+	if root == nil || a.EmailTo != "" {
+		return false
+	}
+	names := root.receivers(a.Labels)
+	if len(names) == 0 {
+		return false
+	}
+	var to, cc, bcc []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		r := receivers[name]
+		to = appendNonEmpty(to, r.EmailTo)
+		cc = appendNonEmpty(cc, r.EmailCc)
+		bcc = appendNonEmpty(bcc, r.EmailBcc)
+	}
+	a.EmailTo = strings.Join(to, ", ")
+	a.EmailCc = strings.Join(appendNonEmpty(cc, a.EmailCc), ", ")
+	a.EmailBcc = strings.Join(appendNonEmpty(bcc, a.EmailBcc), ", ")
+	return true
+}
+
+func appendNonEmpty(list []string, s string) []string {
+	if s == "" {
+		return list
+	}
+	return append(list, s)
+}
+
+// labelMatcher is a filter like "team=ops" or "env!=dev".
+type labelMatcher struct {
+	Key    string
+	Value  string
+	Negate bool
+}
+
+func (m labelMatcher) String() string {
+	if m.Negate {
+		return m.Key + "!=" + m.Value
+	}
+	return m.Key + "=" + m.Value
+}
+
+func parseLabelMatchers(filters []string) ([]labelMatcher, error) {
+	var matchers []labelMatcher
+	for _, f := range filters {
+		var m labelMatcher
+		if i := strings.Index(f, "!="); i > 0 {
+			m = labelMatcher{Key: f[:i], Value: f[i+2:], Negate: true}
+		} else if i := strings.Index(f, "="); i > 0 {
+			m = labelMatcher{Key: f[:i], Value: f[i+1:]}
+		} else {
+			return nil, fmt.Errorf("label filter %q should be like team=ops or env!=dev", f)
+		}
+		matchers = append(matchers, m)
+	}
+	return matchers, nil
+}
+
+func (a alert) matchesLabels(matchers []labelMatcher) bool {
+	for _, m := range matchers {
+		if (a.Labels[m.Key] == m.Value) == m.Negate {
+			return false
+		}
+	}
+	return true
+}
+
+func filterAlerts(alerts []*alert, matchers []labelMatcher) []*alert {
+	if len(matchers) == 0 {
+		return alerts
+	}
+	var filtered []*alert
+	for _, a := range alerts {
+		if a.matchesLabels(matchers) {
+			filtered = append(filtered, a)
+		}
+	}
+	return filtered
+}
+
+// SortedLabels is the alert's labels as "key=value", for display.
+func (a alert) SortedLabels() []labelMatcher {
+	var labels []labelMatcher
+	for k, v := range a.Labels {
+		labels = append(labels, labelMatcher{Key: k, Value: v})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Key < labels[j].Key })
+	return labels
+}
+
+// alertSummary is an alert as the JSON API shows it.
+type alertSummary struct {
+	Name        string            `json:"name"`
+	Hash        string            `json:"hash"`
+	Type        string            `json:"type"`
+	Status      string            `json:"status"`
+	Message     string            `json:"message,omitempty"`
+	Metric      string            `json:"metric,omitempty"`
+	Value       float64           `json:"value"`
+	Threshold   float64           `json:"threshold"`
+	Direction   string            `json:"direction,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Series      []seriesStatus    `json:"series,omitempty"`
+	RootCause   string            `json:"root_cause,omitempty"`
+	Source      string            `json:"source,omitempty"`
+	LastAlerted time.Time         `json:"last_alerted"`
+}
+
+func (a *alert) summary() alertSummary {
+	s := alertSummary{
+		Name:        a.Name,
+		Hash:        a.Hash(),
+		Type:        a.Type,
+		Status:      a.Status,
+		Message:     a.Message,
+		Metric:      a.Metric,
+		Value:       a.Value,
+		Threshold:   a.Threshold,
+		Direction:   a.Direction,
+		Labels:      a.Labels,
+		Series:      a.Series,
+		Source:      a.Source,
+		LastAlerted: a.LastAlerted,
+	}
+	if r := a.RootCause(); r != nil {
+		s.RootCause = r.Name
+	}
+	return s
+}
+
+// alertsAPIHandler serves /api/alerts, optionally filtered by any number
+// of label=key=value or label=key!=value parameters.
+func alertsAPIHandler(ac *alertsCollection, w http.ResponseWriter, r *http.Request) {
+	matchers, err := parseLabelMatchers(r.URL.Query()["label"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	summaries := []alertSummary{}
+	for _, a := range filterAlerts(ac.currentSnapshot().alerts, matchers) {
+		summaries = append(summaries, a.summary())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summaries)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testRouting(t *testing.T) (*route, map[string]receiver) {
+	receivers, err := loadReceivers(configData{Receivers: []receiverData{
+		{Name: "default", EmailTo: "everyone@example.com"},
+		{Name: "ops", EmailTo: "ops@example.com"},
+		{Name: "dba", EmailTo: "dba@example.com", EmailCc: "ops-leads@example.com"},
+		{Name: "audit", EmailBcc: "audit@example.com"},
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := newRoute(routeData{Receiver: "default", Routes: []routeData{
+		{Match: map[string]string{"env": "prod"}, Receiver: "audit", Continue: true},
+		{Match: map[string]string{"team": "ops"}, Receiver: "ops", Routes: []routeData{
+			{MatchRE: map[string]string{"service": "postgres|mysql"}, Receiver: "dba"},
+		}},
+	}}, receivers, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root, receivers
+}
+
+func Test_routeAlert(t *testing.T) {
+	root, receivers := testRouting(t)
+	for _, c := range []struct {
+		labels      map[string]string
+		to, cc, bcc string
+	}{
+		{nil, "everyone@example.com", "", ""},
+		{map[string]string{"team": "ops"}, "ops@example.com", "", ""},
+		{map[string]string{"team": "ops", "service": "mysql"}, "dba@example.com", "ops-leads@example.com", ""},
+		{map[string]string{"team": "ops", "service": "mysql-proxy"}, "ops@example.com", "", ""},
+		{map[string]string{"team": "ops", "env": "prod"}, "ops@example.com", "", "audit@example.com"},
+	} {
+		a := newAlert("a", "a", "", 1, "above", DummyFetcher{}, "", "")
+		a.Labels = c.labels
+		if !routeAlert(a, root, receivers) {
+			t.Errorf("%v: expected a route", c.labels)
+		}
+		if a.EmailTo != c.to || a.EmailCc != c.cc || a.EmailBcc != c.bcc {
+			t.Errorf("%v: got %q %q %q", c.labels, a.EmailTo, a.EmailCc, a.EmailBcc)
+		}
+	}
+
+	a := newAlert("a", "a", "", 1, "above", DummyFetcher{}, "me@example.com", "")
+	a.Labels = map[string]string{"team": "ops"}
+	if routeAlert(a, root, receivers) || a.EmailTo != "me@example.com" {
+		t.Error("an alert's own EmailTo should win")
+	}
+
+	if _, err := newRoute(routeData{Receiver: "nobody"}, receivers, ""); err == nil {
+		t.Error("expected an unknown receiver to be an error")
+	}
+}
+
+func Test_labelFilters(t *testing.T) {
+	if _, err := parseLabelMatchers([]string{"team"}); err == nil {
+		t.Error("expected a filter without a value to be an error")
+	}
+	matchers, err := parseLabelMatchers([]string{"team=ops", "env!=dev"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ac := newAlertsCollection(smtpEmailer{})
+	for name, labels := range map[string]map[string]string{
+		"prod-ops": {"team": "ops", "env": "prod"},
+		"dev-ops":  {"team": "ops", "env": "dev"},
+		"web":      {"team": "web"},
+	} {
+		a := newAlert(name, name, "", 1, "above", DummyFetcher{}, "", "")
+		a.Labels = labels
+		ac.addAlert(a)
+	}
+	ac.publish()
+	if f := filterAlerts(ac.alerts, matchers); len(f) != 1 || f[0].Name != "prod-ops" {
+		t.Errorf("unexpected filtered alerts: %v", f)
+	}
+
+	w := httptest.NewRecorder()
+	alertsAPIHandler(ac, w, httptest.NewRequest("GET", "/api/alerts?label=team=ops", nil))
+	var summaries []alertSummary
+	if err := json.NewDecoder(w.Body).Decode(&summaries); err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 2 || summaries[0].Labels["team"] != "ops" {
+		t.Errorf("unexpected API response: %+v", summaries)
+	}
+
+	w = httptest.NewRecorder()
+	alertsAPIHandler(ac, w, httptest.NewRequest("GET", "/api/alerts?label=oops", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected a bad request, got %d", w.Code)
+	}
+}
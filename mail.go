@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/smtp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// deliveryError reports the recipients the server refused. The message
+// was still delivered to everyone else.
+type deliveryError struct {
+	Failed map[string]error
+}
+
+func (e deliveryError) Error() string {
+	var parts []string
+	for rcpt, err := range e.Failed {
+		parts = append(parts, fmt.Sprintf("%s: %v", rcpt, err))
+	}
+	sort.Strings(parts)
+	return "delivery failed for " + strings.Join(parts, "; ")
+}
+
+func sendMail(m mailMessage) error {
+	log.WithFields(
+		log.Fields{
+			"From":    m.From,
+			"To":      m.To,
+			"Cc":      m.Cc,
+			"Subject": m.Subject,
+		},
+	).Debug("sendMail")
+	if len(m.recipients()) == 0 {
+		log.WithFields(log.Fields{"Subject": m.Subject}).Error("no recipients")
+		return fmt.Errorf("no recipients for %q", m.Subject)
+	}
+	settingsMu.RLock()
+	transport := mailTransport
+	settingsMu.RUnlock()
+	c, err := transport.Dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return deliver(c, m.withGraphs())
+}
+
+// deliver sends m over an established connection. Recipients the server
+// refuses are reported in a deliveryError rather than stopping the
+// message from reaching the rest.
+func deliver(c *smtp.Client, m mailMessage) error {
+	message := m.Bytes()
+
+	// To && From
+	if err := c.Mail(m.envelopeFrom()); err != nil {
+		log.WithFields(log.Fields{"err": err, "from": m.From}).Error("from address failed")
+		return err
+	}
+
+	failed := make(map[string]error)
+	recipients := m.recipients()
+	for _, rcpt := range recipients {
+		if err := c.Rcpt(rcpt); err != nil {
+			log.WithFields(log.Fields{"err": err, "to": rcpt}).Error("to address failed")
+			failed[rcpt] = err
+		}
+	}
+	if len(failed) == len(recipients) {
+		c.Reset()
+		return deliveryError{Failed: failed}
+	}
+
+	// Data
+	w, err := c.Data()
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("smtp Data() failed")
+		return err
+	}
+
+	_, err = w.Write(message)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("smtp Write failed")
+		return err
+	}
+
+	err = w.Close()
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("smtp close failed")
+		return err
+	}
+
+	c.Quit()
+	if len(failed) > 0 {
+		return deliveryError{Failed: failed}
+	}
+	return nil
+}
+
+func encodeRFC2047(s string) string {
+	// only encodes if there's something that needs it
+	return mime.QEncoding.Encode("utf-8", s)
+}
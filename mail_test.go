@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSMTPServer speaks just enough SMTP to accept a message, refusing
+// any recipient listed in reject. With tlsConfig set it offers
+// STARTTLS, and with auth set it offers AUTH and records the
+// credentials it was given.
+type fakeSMTPServer struct {
+	ln        net.Listener
+	reject    map[string]bool
+	tlsConfig *tls.Config
+	auth      bool
+
+	mu       sync.Mutex
+	rcpts    []string
+	messages []string
+	authed   []string
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTPServer{ln: ln, reject: make(map[string]bool)}
+	go s.serve()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *fakeSMTPServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *fakeSMTPServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeSMTPServer) handle(conn net.Conn) {
+	defer func() { conn.Close() }()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost fake ESMTP")
+	_, secure := conn.(*tls.Conn)
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		verb := strings.ToUpper(fields[0])
+		switch verb {
+		case "EHLO", "HELO":
+			ext := []string{"localhost"}
+			if s.tlsConfig != nil && !secure {
+				ext = append(ext, "STARTTLS")
+			}
+			if s.auth {
+				ext = append(ext, "AUTH PLAIN LOGIN CRAM-MD5")
+			}
+			for i, e := range ext {
+				sep := "-"
+				if i == len(ext)-1 {
+					sep = " "
+				}
+				tp.PrintfLine("250%s%s", sep, e)
+			}
+		case "STARTTLS":
+			tp.PrintfLine("220 go ahead")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+			tp = textproto.NewConn(conn)
+			secure = true
+		case "AUTH":
+			s.handleAuth(tp, fields[1:])
+		case "MAIL", "NOOP", "RSET":
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			rcpt := strings.Trim(strings.TrimPrefix(line[len("RCPT "):], "TO:"), "<>")
+			if s.reject[rcpt] {
+				tp.PrintfLine("550 no such user")
+				continue
+			}
+			s.mu.Lock()
+			s.rcpts = append(s.rcpts, rcpt)
+			s.mu.Unlock()
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			b, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, string(b))
+			s.mu.Unlock()
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func (s *fakeSMTPServer) handleAuth(tp *textproto.Conn, args []string) {
+	decode := func(b64 string) string {
+		b, _ := base64.StdEncoding.DecodeString(b64)
+		return string(b)
+	}
+	challenge := func(prompt string) string {
+		tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(prompt)))
+		line, _ := tp.ReadLine()
+		return decode(line)
+	}
+	var record string
+	switch strings.ToUpper(args[0]) {
+	case "PLAIN":
+		parts := strings.Split(decode(args[1]), "\x00")
+		record = "PLAIN " + parts[1] + " " + parts[2]
+	case "LOGIN":
+		user := challenge("Username:")
+		record = "LOGIN " + user + " " + challenge("Password:")
+	case "CRAM-MD5":
+		record = "CRAM-MD5 " + challenge("<1.1@localhost>")
+	}
+	s.mu.Lock()
+	s.authed = append(s.authed, record)
+	s.mu.Unlock()
+	tp.PrintfLine("235 authenticated")
+}
+
+func Test_deliverMultipleRecipients(t *testing.T) {
+	s := newFakeSMTPServer(t)
+	s.reject["bounce@example.com"] = true
+
+	c, err := smtp.Dial(s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mailMessage{From: "hound@example.com",
+		To:      "one@example.com, Two <two@example.com>, bounce@example.com",
+		Cc:      "three@example.com",
+		Bcc:     "hidden@example.com, one@example.com",
+		Subject: "[ALERT] Überwachung", Text: "body"}
+	err = deliver(c, m)
+
+	de, ok := err.(deliveryError)
+	if !ok {
+		t.Fatal("expected a deliveryError, got", err)
+	}
+	if len(de.Failed) != 1 || de.Failed["bounce@example.com"] == nil {
+		t.Error("expected only bounce@example.com to fail", de)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if strings.Join(s.rcpts, " ") != "one@example.com two@example.com three@example.com hidden@example.com" {
+		t.Error("wrong recipients:", s.rcpts)
+	}
+	if len(s.messages) != 1 {
+		t.Fatal("expected the message to be delivered")
+	}
+	if strings.Contains(s.messages[0], "hidden@example.com") {
+		t.Error("bcc recipients shouldn't appear in the headers")
+	}
+	if !strings.Contains(s.messages[0], "Subject: =?utf-8?q?[ALERT]_=C3=9Cberwachung?=") {
+		t.Error("subject wasn't encoded:", s.messages[0])
+	}
+}
+
+func Test_deliverAllRecipientsRefused(t *testing.T) {
+	s := newFakeSMTPServer(t)
+	s.reject["bounce@example.com"] = true
+	c, err := smtp.Dial(s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = deliver(c, mailMessage{From: "hound@example.com", To: "bounce@example.com", Text: "body"})
+	if _, ok := err.(deliveryError); !ok {
+		t.Error("expected a deliveryError, got", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.messages) != 0 {
+		t.Error("nothing should have been delivered")
+	}
+}
+
+func Test_encodeRFC2047(t *testing.T) {
+	if encodeRFC2047("[ALERT] foo") != "[ALERT] foo" {
+		t.Error("plain ascii should be left alone")
+	}
+	if encodeRFC2047("naïve") == "naïve" {
+		t.Error("non-ascii should be encoded")
+	}
+}
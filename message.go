@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// inlineImage is an image the HTML refers to by "cid:". A graph is
+// queued with just its URL and only fetched as the message is sent.
+type inlineImage struct {
+	ContentID   string
+	ContentType string `json:",omitempty"`
+	URL         string `json:",omitempty"`
+	Data        []byte `json:",omitempty"`
+}
+
+// mailMessage is an outgoing email. With no HTML it goes out as a plain
+// text message like it always has. With HTML it becomes
+// multipart/alternative, the text kept as the fallback, and the HTML
+// wrapped in multipart/related along with any inline images it refers
+// to by "cid:".
+//
+// To, Cc and Bcc are comma separated address lists. Bcc recipients get
+// the message but never appear in its headers.
+type mailMessage struct {
+	From      string
+	To        string
+	Cc        string
+	Bcc       string
+	Subject   string
+	Text      string
+	HTML      string
+	Inline    []inlineImage
+	Date      time.Time
+	MessageID string
+	// InReplyTo and References thread the message onto earlier ones
+	InReplyTo  string
+	References string
+	// Envelope, when set, overrides who actually gets it, for resending
+	// to just the recipients that failed
+	Envelope []string
+}
+
+// parseAddressList is forgiving: a list net/mail won't parse is split on
+// commas as is, and the server gets to decide.
+func parseAddressList(list string) []*mail.Address {
+	if strings.TrimSpace(list) == "" {
+		return nil
+	}
+	addrs, err := mail.ParseAddressList(list)
+	if err == nil {
+		return addrs
+	}
+	addrs = nil
+	for _, a := range strings.Split(list, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addrs = append(addrs, &mail.Address{Address: a})
+		}
+	}
+	return addrs
+}
+
+func formatAddressList(list string) string {
+	var formatted []string
+	for _, a := range parseAddressList(list) {
+		formatted = append(formatted, a.String())
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// recipients is every envelope recipient, without duplicates.
+func (m mailMessage) recipients() []string {
+	if len(m.Envelope) > 0 {
+		return m.Envelope
+	}
+	var rcpts []string
+	seen := make(map[string]bool)
+	for _, list := range []string{m.To, m.Cc, m.Bcc} {
+		for _, a := range parseAddressList(list) {
+			key := strings.ToLower(a.Address)
+			if !seen[key] {
+				seen[key] = true
+				rcpts = append(rcpts, a.Address)
+			}
+		}
+	}
+	return rcpts
+}
+
+func (m mailMessage) envelopeFrom() string {
+	if addrs := parseAddressList(m.From); len(addrs) > 0 {
+		return addrs[0].Address
+	}
+	return m.From
+}
+
+// domain is the part of the sender address used to make Message-IDs
+// globally unique.
+func (m mailMessage) domain() string {
+	from := m.envelopeFrom()
+	if i := strings.LastIndex(from, "@"); i >= 0 && i < len(from)-1 {
+		return from[i+1:]
+	}
+	return "hound.localhost"
+}
+
+func (m mailMessage) messageID() string {
+	if m.MessageID != "" {
+		return m.MessageID
+	}
+	b := make([]byte, 12)
+	rand.Read(b)
+	return fmt.Sprintf("<%x.%d@%s>", b, time.Now().UnixNano(), m.domain())
+}
+
+func (m mailMessage) headers() []string {
+	date := m.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	headers := []string{
+		"From: " + formatAddressList(m.From),
+		"To: " + formatAddressList(m.To),
+	}
+	if m.Cc != "" {
+		headers = append(headers, "Cc: "+formatAddressList(m.Cc))
+	}
+	headers = append(headers,
+		"Subject: "+encodeRFC2047(m.Subject),
+		"Date: "+date.Format(time.RFC1123Z),
+		"Message-ID: "+m.messageID(),
+		"MIME-Version: 1.0",
+	)
+	if m.InReplyTo != "" {
+		headers = append(headers, "In-Reply-To: "+m.InReplyTo)
+	}
+	if m.References != "" {
+		headers = append(headers, "References: "+m.References)
+	}
+	return headers
+}
+
+func (m mailMessage) Bytes() []byte {
+	var buf bytes.Buffer
+	for _, h := range m.headers() {
+		buf.WriteString(h + "\r\n")
+	}
+	if m.HTML == "" {
+		buf.WriteString("Content-Type: text/plain; charset=\"utf-8\"\r\n")
+		buf.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+		writeWrappedBase64(&buf, []byte(m.Text))
+		return buf.Bytes()
+	}
+
+	alternative := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", alternative.Boundary())
+	writeBase64Part(alternative, "text/plain; charset=\"utf-8\"", nil, []byte(m.Text))
+
+	var related bytes.Buffer
+	rw := multipart.NewWriter(&related)
+	writeBase64Part(rw, "text/html; charset=\"utf-8\"", nil, []byte(m.HTML))
+	for _, img := range m.Inline {
+		writeBase64Part(rw, img.ContentType, textproto.MIMEHeader{
+			"Content-ID":          {"<" + img.ContentID + ">"},
+			"Content-Disposition": {"inline"},
+		}, img.Data)
+	}
+	rw.Close()
+
+	part, _ := alternative.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {fmt.Sprintf("multipart/related; boundary=%q", rw.Boundary())},
+	})
+	part.Write(related.Bytes())
+	alternative.Close()
+	return buf.Bytes()
+}
+
+func writeBase64Part(w *multipart.Writer, contentType string, header textproto.MIMEHeader, data []byte) {
+	if header == nil {
+		header = textproto.MIMEHeader{}
+	}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Transfer-Encoding", "base64")
+	part, _ := w.CreatePart(header)
+	writeWrappedBase64(part, data)
+}
+
+// writeWrappedBase64 keeps lines under the 998 character limit, which a
+// graph image would otherwise blow straight past.
+func writeWrappedBase64(w io.Writer, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		io.WriteString(w, encoded[:76]+"\r\n")
+		encoded = encoded[76:]
+	}
+	io.WriteString(w, encoded+"\r\n")
+}
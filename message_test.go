@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_mailMessagePlain(t *testing.T) {
+	text := "foo has triggered an alert\n" + strings.Repeat("a long digest line ", 100)
+	m := mailMessage{From: "hound@example.com", To: "test@example.com",
+		Subject: "[ALERT] foo", Text: text}
+	raw := m.Bytes()
+	for _, line := range strings.Split(string(raw), "\r\n") {
+		if len(line) > 998 {
+			t.Fatal("line too long")
+		}
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("Content-Type") != "text/plain; charset=\"utf-8\"" {
+		t.Error("wrong content type:", msg.Header.Get("Content-Type"))
+	}
+	body, _ := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, msg.Body))
+	if string(body) != text {
+		t.Error("wrong body:", string(body))
+	}
+}
+
+func Test_mailMessageHTML(t *testing.T) {
+	img := bytes.Repeat([]byte{0x89, 'P', 'N', 'G'}, 100)
+	m := mailMessage{From: "hound@example.com", To: "test@example.com",
+		Subject: "[ALERT] foo", Text: "plain", HTML: "<img src=\"cid:daily@hound\">",
+		Inline: []inlineImage{{ContentID: "daily@hound", ContentType: "image/png", Data: img}}}
+	raw := m.Bytes()
+	for _, line := range strings.Split(string(raw), "\r\n") {
+		if len(line) > 998 {
+			t.Fatal("line too long")
+		}
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if mediaType != "multipart/alternative" {
+		t.Fatal("wrong content type:", mediaType)
+	}
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	text, err := r.NextPart()
+	if err != nil || !strings.HasPrefix(text.Header.Get("Content-Type"), "text/plain") {
+		t.Fatal("expected a plain text part first")
+	}
+	related, err := r.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, _ = mime.ParseMediaType(related.Header.Get("Content-Type"))
+	if mediaType != "multipart/related" {
+		t.Fatal("expected a related part, got", mediaType)
+	}
+	rr := multipart.NewReader(related, params["boundary"])
+	html, _ := rr.NextPart()
+	if !strings.HasPrefix(html.Header.Get("Content-Type"), "text/html") {
+		t.Error("expected the html part first")
+	}
+	image, err := rr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.Header.Get("Content-ID") != "<daily@hound>" {
+		t.Error("wrong content id:", image.Header.Get("Content-ID"))
+	}
+	data, _ := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, image))
+	if !bytes.Equal(data, img) {
+		t.Error("image didn't survive the round trip")
+	}
+}
+
+func Test_mailMessageHeaders(t *testing.T) {
+	date := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	m := mailMessage{From: "Hound <hound@example.com>", To: "one@example.com,two@example.com",
+		Cc: "three@example.com", Bcc: "hidden@example.com",
+		Subject: "[ALERT] café", Text: "body", Date: date}
+	msg, err := mail.ReadMessage(bytes.NewReader(m.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := msg.Header.AddressList("To")
+	if err != nil || len(to) != 2 {
+		t.Error("expected two To addresses", to, err)
+	}
+	if msg.Header.Get("Cc") != "<three@example.com>" {
+		t.Error("wrong Cc:", msg.Header.Get("Cc"))
+	}
+	if msg.Header.Get("Bcc") != "" {
+		t.Error("Bcc shouldn't be in the headers")
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if subject != "[ALERT] café" {
+		t.Error("wrong subject:", subject)
+	}
+	if d, _ := msg.Header.Date(); !d.Equal(date) {
+		t.Error("wrong date:", msg.Header.Get("Date"))
+	}
+	if !strings.HasSuffix(msg.Header.Get("Message-ID"), "@example.com>") {
+		t.Error("wrong Message-ID:", msg.Header.Get("Message-ID"))
+	}
+	if strings.Join(m.recipients(), " ") != "one@example.com two@example.com three@example.com hidden@example.com" {
+		t.Error("wrong recipients:", m.recipients())
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Every subject and body Hound sends is a named text/template. These
+// are the defaults; a template file (global or per alert) only needs to
+// {{define}} the ones it wants to change.
+const defaultNotificationTemplates = `
+{{- define "alert_subject"}}{{if eq .Alert.Type "Alert"}}[ALERT]{{else}}[NOTICE]{{end}} {{.Alert.Name}}{{end}}
+
+{{- define "alert_body"}}{{if .Alert.IsComposite -}}
+{{.Alert.Name}} has triggered an alert
+Status:	{{.Alert.Status}}
+Message:	{{.Alert.Message}}
+
+{{.Alert.ChildrenSummary}}{{.Alert.IncludeRunBookLink}}
+{{else -}}
+{{.Alert.Name}} [{{.Alert.Metric}}] has triggered an alert
+Status:	{{.Alert.Status}}
+Message:	{{.Alert.Message}}
+
+Daily Graph: <{{.Alert.DailyGraphURL}}>
+Weekly Graph: <{{.Alert.WeeklyGraphURL}}>{{.Alert.IncludeRunBookLink}}
+{{end}}{{if .AckURL}}
+To acknowledge it: <{{.AckURL}}>
+{{end}}{{end}}
+
+{{- define "recovery_subject"}}[RECOVERED] {{.Alert.Name}}{{end}}
+
+{{- define "recovery_body"}}{{.Alert.Name}} [{{.Alert.Metric}}] has returned {{invertDirection .Alert.Direction}} {{printf "%f" .Alert.Threshold}}{{end}}
+
+{{- define "escalation_subject"}}[ESCALATED] {{.Alert.Name}} (tier {{.Tier}}){{end}}
+
+{{- define "escalation_body"}}{{template "alert_body" .}}
+Nobody has acknowledged this alert yet.
+{{end}}
+
+{{- define "throttled_subject"}}[ALERT] Hound is throttled{{end}}
+
+{{- define "throttled_body"}}{{.Count}} metrics were not OK.
+Hound stopped sending messages after {{.Throttle}}.
+This probably indicates an infrastructure problem (network, graphite, etc){{end}}
+
+{{- define "recovery_throttled_subject"}}[ALERT] Hound is recovered{{end}}
+
+{{- define "recovery_throttled_body"}}{{.Count}} metrics recovered.
+Hound stopped sending individual messages after {{.Throttle}}.
+{{end}}
+
+{{- define "errors_subject"}}[ERROR] Hound encountered errors{{end}}
+
+{{- define "digest_subject"}}[DIGEST] Hound: {{.Alerts}} alerting, {{.Recoveries}} recovered{{end}}
+
+{{- define "digest_body"}}{{range .Entries}}{{if eq .Kind "recovery"}}[RECOVERED]{{else if eq .Type "Notice"}}[NOTICE]{{else}}[ALERT]{{end}} {{.Name}}
+Status:	{{.Status}}{{if .Metric}}
+Value:	{{.Value}} ({{if eq .Kind "recovery"}}{{invertDirection .Direction}}{{else}}{{.Direction}}{{end}} {{printf "%f" .Threshold}}){{end}}{{if .Message}}
+Message:	{{.Message}}{{end}}{{if .GraphURL}}
+Graph: <{{.GraphURL}}>{{end}}{{if .AlertURL}}
+Details: <{{.AlertURL}}>{{end}}
+
+{{end}}{{end}}
+
+{{- define "report_subject"}}[REPORT] Hound: {{len .Failing}} failing{{end}}
+
+{{- define "report_body"}}Hound status report, {{.Since.Format "Mon Jan 2 15:04"}} to {{.Until.Format "Mon Jan 2 15:04"}}
+{{len .Failing}} of {{.Alerts}} alerts failing now, {{.FailingFor}} spent failing in total.
+{{if .Failing}}
+Failing now:
+{{range .Failing}}  {{.Name}}: {{.Status}}{{if .Message}} ({{.Message}}){{end}}
+{{end}}{{end}}{{if .MostFired}}
+Fired most:
+{{range .MostFired}}  {{.Name}}: {{.Fired}} time{{if ne .Fired 1}}s{{end}}, failing for {{.FailingFor}}
+{{end}}{{end}}{{if .Notices}}
+Notices:
+{{range .Notices}}  {{.Name}}: {{.Status}}{{if .Message}} ({{.Message}}){{end}}
+{{end}}{{end}}{{if .DashboardURL}}
+{{.DashboardURL}}
+{{end}}{{end}}
+
+{{- define "errors_body"}}{{.Count}} metrics had errors. If this is more than a couple, it usually means that Graphite has fallen behind. It doesn't necessarily mean that there are problems with the services, but it means that Hound is temporarily blind wrt these metrics.{{end}}
+`
+
+var alertTemplateNames = []string{"alert_subject", "alert_body", "recovery_subject", "recovery_body",
+	"escalation_subject", "escalation_body"}
+var collectionTemplateNames = []string{"throttled_subject", "throttled_body",
+	"recovery_throttled_subject", "recovery_throttled_body", "errors_subject", "errors_body"}
+var digestTemplateNames = []string{"digest_subject", "digest_body"}
+var reportTemplateNames = []string{"report_subject", "report_body"}
+
+var templateFuncs = template.FuncMap{
+	"upper":           strings.ToUpper,
+	"lower":           strings.ToLower,
+	"join":            strings.Join,
+	"round":           roundToFourPlaces,
+	"invertDirection": invertDirection,
+	"since": func(t time.Time) string {
+		return time.Since(t).Round(time.Second).String()
+	},
+}
+
+// dashboardURL is where Hound's web UI can be reached from outside, for
+// links in notifications.
+var dashboardURL string
+
+var baseNotificationTemplates = template.Must(
+	template.New("notifications").Funcs(templateFuncs).Parse(defaultNotificationTemplates))
+
+// notificationTemplates are the templates in effect for every alert that
+// doesn't have its own.
+var notificationTemplates = baseNotificationTemplates
+
+type alertNotificationData struct {
+	Alert        *alert
+	DashboardURL string
+	AlertURL     string
+	// AckURL is AlertURL with what it takes to acknowledge the current
+	// incident, empty if there isn't one
+	AckURL string
+	// Tier is the escalation tier being notified, from 1
+	Tier int
+}
+
+type collectionNotificationData struct {
+	Count        int
+	Throttle     int
+	DashboardURL string
+}
+
+// loadNotificationTemplates layers the {{define}}s in file over base.
+func loadNotificationTemplates(base *template.Template, file string) (*template.Template, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	t, err := base.Clone()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = t.New(file).Parse(string(content)); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// validateNotificationTemplates renders every template once against a
+// sample alert so that a reference to a field that doesn't exist fails
+// at startup rather than when something breaks.
+func validateNotificationTemplates(t *template.Template) error {
+	sample := newAlert("sample", "sample.metric", "", 1, "above", nil, "test@example.com", "")
+	sample.Status = "Failed"
+	for _, name := range alertTemplateNames {
+		if err := t.ExecuteTemplate(ioutil.Discard, name, sample.notificationData()); err != nil {
+			return err
+		}
+	}
+	for _, name := range collectionTemplateNames {
+		data := collectionNotificationData{Count: 1, Throttle: 1, DashboardURL: dashboardURL}
+		if err := t.ExecuteTemplate(ioutil.Discard, name, data); err != nil {
+			return err
+		}
+	}
+	digestData := digestNotificationData{Recipient: "test@example.com",
+		Entries: []digestEntry{sample.digestEntry("alert")}, Alerts: 1, DashboardURL: dashboardURL}
+	for _, name := range digestTemplateNames {
+		if err := t.ExecuteTemplate(ioutil.Discard, name, digestData); err != nil {
+			return err
+		}
+	}
+	reportData := reportNotificationData{Since: time.Now(), Until: time.Now(), Alerts: 1,
+		Failing: []reportEntry{sample.reportEntry()}, DashboardURL: dashboardURL}
+	reportData.MostFired = reportData.Failing
+	reportData.Notices = reportData.Failing
+	for _, name := range reportTemplateNames {
+		if err := t.ExecuteTemplate(ioutil.Discard, name, reportData); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// alertTemplateCache lets alerts that use the same template file share
+// the parsed result.
+type alertTemplateCache struct {
+	// the global templates the per-alert ones go on top of
+	base   *template.Template
+	parsed map[string]*template.Template
+}
+
+func newAlertTemplateCache(base *template.Template) *alertTemplateCache {
+	return &alertTemplateCache{base: base, parsed: make(map[string]*template.Template)}
+}
+
+// load parses a per-alert template file on top of the global templates.
+func (c *alertTemplateCache) load(file string) (*template.Template, error) {
+	if t, ok := c.parsed[file]; ok {
+		return t, nil
+	}
+	t, err := loadNotificationTemplates(c.base, file)
+	if err != nil {
+		return nil, err
+	}
+	if err = validateNotificationTemplates(t); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	c.parsed[file] = t
+	return t, nil
+}
+
+func (a *alert) notificationData() alertNotificationData {
+	d := alertNotificationData{Alert: a, DashboardURL: dashboardURL}
+	if dashboardURL != "" {
+		d.AlertURL = strings.TrimRight(dashboardURL, "/") + "/alert/" + a.Hash() + "/"
+		if token := a.ackToken(); token != "" {
+			d.AckURL = d.AlertURL + "?ack=" + token
+		}
+	}
+	return d
+}
+
+func renderTemplate(t *template.Template, name string, data interface{}) string {
+	var buf bytes.Buffer
+	err := t.ExecuteTemplate(&buf, name, data)
+	if err == nil {
+		return buf.String()
+	}
+	log.WithFields(log.Fields{
+		"template": name,
+		"error":    fmt.Sprintf("%v", err),
+	}).Error("error rendering notification, falling back to the default")
+	buf.Reset()
+	baseNotificationTemplates.ExecuteTemplate(&buf, name, data)
+	return buf.String()
+}
+
+func (a *alert) render(name string) string {
+	t := a.templates
+	if t == nil {
+		t = notificationTemplates
+	}
+	return renderTemplate(t, name, a.notificationData())
+}
+
+func renderCollectionTemplate(name string, count, throttle int) string {
+	return renderTemplate(notificationTemplates, name,
+		collectionNotificationData{Count: count, Throttle: throttle, DashboardURL: dashboardURL})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTempFile(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func Test_defaultAlertEmailBody(t *testing.T) {
+	a := newAlert("foo", "foo", "", 10, "above", DummyFetcher{}, "test@example.com", "runbook")
+	a.Status = "Failed"
+	a.Message = "11.000000 >= 10.000000"
+	expected := fmt.Sprintf("%s [%s] has triggered an alert\nStatus:\t%s\nMessage:\t%s\n\nDaily Graph: <%s>\nWeekly Graph: <%s>%s\n",
+		a.Name, a.Metric, a.Status, a.Message, a.DailyGraphURL(), a.WeeklyGraphURL(), a.IncludeRunBookLink())
+	if a.alertEmailBody() != expected {
+		t.Error("wrong value:", a.alertEmailBody())
+	}
+}
+
+func Test_defaultCollectionTemplates(t *testing.T) {
+	if renderCollectionTemplate("throttled_subject", 12, 10) != "[ALERT] Hound is throttled" {
+		t.Error("wrong subject")
+	}
+	body := renderCollectionTemplate("throttled_body", 12, 10)
+	if !strings.HasPrefix(body, "12 metrics were not OK.\nHound stopped sending messages after 10.\n") {
+		t.Error("wrong value:", body)
+	}
+}
+
+func Test_loadNotificationTemplates(t *testing.T) {
+	path := writeTempFile(t, "notify.tmpl",
+		`{{define "alert_subject"}}[{{upper .Alert.Type}}] {{.Alert.Name}} on {{.DashboardURL}}{{end}}`)
+	tmpl, err := loadNotificationTemplates(baseNotificationTemplates, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateNotificationTemplates(tmpl); err != nil {
+		t.Fatal(err)
+	}
+
+	dashboardURL = "https://hound.example.com/"
+	defer func() { dashboardURL = "" }()
+	a := newAlert("foo", "foo", "", 10, "above", DummyFetcher{}, "test@example.com", "")
+	a.templates = tmpl
+	if a.alertEmailSubject() != "[ALERT] foo on https://hound.example.com/" {
+		t.Error("wrong value:", a.alertEmailSubject())
+	}
+	if a.RecoveryEmailSubject() != "[RECOVERED] foo" {
+		t.Error("templates that aren't overridden should keep the default")
+	}
+	if a.notificationData().AlertURL != "https://hound.example.com/alert/"+a.Hash()+"/" {
+		t.Error("wrong alert url:", a.notificationData().AlertURL)
+	}
+}
+
+func Test_validateNotificationTemplatesFails(t *testing.T) {
+	path := writeTempFile(t, "broken.tmpl", `{{define "recovery_body"}}{{.Alert.NoSuchField}}{{end}}`)
+	tmpl, err := loadNotificationTemplates(baseNotificationTemplates, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if validateNotificationTemplates(tmpl) == nil {
+		t.Error("expected a reference to a missing field to fail validation")
+	}
+
+	path = writeTempFile(t, "unparseable.tmpl", `{{define "alert_subject"}}{{.Alert.Name`)
+	if _, err := loadNotificationTemplates(baseNotificationTemplates, path); err == nil {
+		t.Error("expected a parse error")
+	}
+}
+
+func Test_loadAlertTemplatesCache(t *testing.T) {
+	path := writeTempFile(t, "alert.tmpl", `{{define "alert_subject"}}custom{{end}}`)
+	cache := newAlertTemplateCache(baseNotificationTemplates)
+	t1, err := cache.load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t2, _ := cache.load(path)
+	if t1 != t2 {
+		t.Error("expected the same file to be parsed once")
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A notification window limits when an alert may notify anyone, so
+// that, say, Notices only email people during the working day.
+
+type notificationWindow struct {
+	Name     string
+	Outside  string
+	Types    []string
+	location *time.Location
+	// days is empty for every day
+	days map[time.Weekday]bool
+	// start and end are minutes into the day; end before start means
+	// the window runs past midnight
+	start, end int
+	// for Outside "digest", what's waiting for the window to open
+	digest *digestCollector
+}
+
+func parseClock(s string) (int, error) {
+	hm := strings.SplitN(s, ":", 2)
+	if len(hm) != 2 {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+	h, err := strconv.Atoi(hm[0])
+	if err != nil || h < 0 || h > 24 {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+	m, err := strconv.Atoi(hm[1])
+	if err != nil || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+	return h*60 + m, nil
+}
+
+func newNotificationWindow(d notificationWindowData) (*notificationWindow, error) {
+	if d.Name == "" {
+		return nil, errors.New("notification window without a name")
+	}
+	w := &notificationWindow{Name: d.Name, Outside: strings.ToLower(d.Outside), Types: d.Types,
+		days: make(map[time.Weekday]bool)}
+	var err error
+	if w.location, err = time.LoadLocation(d.TimeZone); err != nil {
+		return nil, fmt.Errorf("notification window %s: %v", d.Name, err)
+	}
+	for _, day := range d.Days {
+		key := strings.ToLower(day)
+		if len(key) > 3 {
+			key = key[:3]
+		}
+		wd, ok := weekdays[key]
+		if !ok {
+			return nil, fmt.Errorf("notification window %s: unknown day %q", d.Name, day)
+		}
+		w.days[wd] = true
+	}
+	if w.start, err = parseClock(d.Start); err != nil {
+		return nil, fmt.Errorf("notification window %s: %v", d.Name, err)
+	}
+	if w.end, err = parseClock(d.End); err != nil {
+		return nil, fmt.Errorf("notification window %s: %v", d.Name, err)
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("notification window %s starts when it ends", d.Name)
+	}
+	switch w.Outside {
+	case "drop", "defer":
+	case "digest":
+		w.digest = newDigestCollector(0)
+	default:
+		return nil, fmt.Errorf("notification window %s: Outside should be drop, defer or digest, not %q",
+			d.Name, d.Outside)
+	}
+	return w, nil
+}
+
+func (w *notificationWindow) onDay(d time.Weekday) bool {
+	return len(w.days) == 0 || w.days[d]
+}
+
+// Open says whether notifications can go out at t. A window that runs
+// past midnight belongs to the day it starts on.
+func (w *notificationWindow) Open(t time.Time) bool {
+	t = t.In(w.location)
+	m := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return w.onDay(t.Weekday()) && m >= w.start && m < w.end
+	}
+	if m >= w.start {
+		return w.onDay(t.Weekday())
+	}
+	return m < w.end && w.onDay(t.AddDate(0, 0, -1).Weekday())
+}
+
+// NextOpen is t if the window's open, or else when it next opens.
+func (w *notificationWindow) NextOpen(t time.Time) time.Time {
+	if w.Open(t) {
+		return t
+	}
+	lt := t.In(w.location)
+	for i := 0; i <= 7; i++ {
+		day := lt.AddDate(0, 0, i)
+		open := time.Date(day.Year(), day.Month(), day.Day(), w.start/60, w.start%60, 0, 0, w.location)
+		if open.After(t) && w.onDay(open.Weekday()) {
+			return open
+		}
+	}
+	return t
+}
+
+// loadNotificationWindows builds the windows in the config, in order.
+func loadNotificationWindows(f configData) ([]*notificationWindow, error) {
+	var windows []*notificationWindow
+	seen := make(map[string]bool)
+	for _, d := range f.NotificationWindows {
+		w, err := newNotificationWindow(d)
+		if err != nil {
+			return nil, err
+		}
+		if seen[w.Name] {
+			return nil, fmt.Errorf("duplicate notification window %s", w.Name)
+		}
+		seen[w.Name] = true
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// windowFor is the named window, or else the first one for the alert
+// type. A name that isn't a window is an error.
+func windowFor(windows []*notificationWindow, name, alertType string) (*notificationWindow, error) {
+	for _, w := range windows {
+		if name != "" && w.Name == name {
+			return w, nil
+		}
+	}
+	if name != "" {
+		return nil, fmt.Errorf("unknown notification window %s", name)
+	}
+	for _, w := range windows {
+		for _, t := range w.Types {
+			if t == alertType {
+				return w, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// holdNotification deals with a notification (kind "alert" or
+// "recovery") outside the alert's window. It returns true if it was
+// dropped or held for a digest, and otherwise when to send it.
+func (a *alert) holdNotification(kind string, now time.Time) (bool, time.Time) {
+	w := a.NotifyWindow
+	if w == nil || w.Open(now) {
+		return false, time.Time{}
+	}
+	log.WithFields(log.Fields{
+		"name":    a.Name,
+		"window":  w.Name,
+		"outside": w.Outside,
+	}).Debug("outside notification window")
+	switch w.Outside {
+	case "drop":
+		return true, time.Time{}
+	case "digest":
+		m, _ := a.notificationRecipients(now)
+		w.digest.Add(m.recipients(), a.digestEntry(kind))
+		return true, time.Time{}
+	}
+	return false, w.NextOpen(now)
+}
+
+// flushWindowDigests sends the digests for windows that have opened.
+func flushWindowDigests(windows []*notificationWindow, now time.Time) {
+	for _, w := range windows {
+		if w.digest == nil || !w.Open(now) {
+			continue
+		}
+		for _, m := range w.digest.Flush(now) {
+			queueMail(m)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func testWindow(t *testing.T, outside string) *notificationWindow {
+	w, err := newNotificationWindow(notificationWindowData{
+		Name: "business", TimeZone: "America/New_York",
+		Days: []string{"Mon", "Tue", "Wed", "Thu", "Fri"}, Start: "09:00", End: "17:00",
+		Outside: outside, Types: []string{"Notice"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func Test_notificationWindowOpen(t *testing.T) {
+	w := testWindow(t, "drop")
+	ny := w.location
+	// 2020-07-17 is a Friday
+	for _, c := range []struct {
+		when time.Time
+		open bool
+		next time.Time
+	}{
+		{time.Date(2020, 7, 17, 10, 0, 0, 0, ny), true, time.Date(2020, 7, 17, 10, 0, 0, 0, ny)},
+		{time.Date(2020, 7, 17, 3, 0, 0, 0, ny), false, time.Date(2020, 7, 17, 9, 0, 0, 0, ny)},
+		{time.Date(2020, 7, 17, 17, 0, 0, 0, ny), false, time.Date(2020, 7, 20, 9, 0, 0, 0, ny)},
+		{time.Date(2020, 7, 18, 12, 0, 0, 0, ny), false, time.Date(2020, 7, 20, 9, 0, 0, 0, ny)},
+	} {
+		if w.Open(c.when) != c.open {
+			t.Errorf("%v: expected open to be %v", c.when, c.open)
+		}
+		if n := w.NextOpen(c.when.UTC()); !n.Equal(c.next) {
+			t.Errorf("%v: expected to open next at %v, got %v", c.when, c.next, n)
+		}
+	}
+
+	night, err := newNotificationWindow(notificationWindowData{
+		Name: "night", Days: []string{"Fri"}, Start: "22:00", End: "06:00", Outside: "drop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !night.Open(time.Date(2020, 7, 18, 5, 0, 0, 0, time.UTC)) {
+		t.Error("Friday night's window should still be open early Saturday")
+	}
+	if night.Open(time.Date(2020, 7, 17, 5, 0, 0, 0, time.UTC)) {
+		t.Error("early Friday belongs to Thursday night")
+	}
+}
+
+func Test_newNotificationWindowErrors(t *testing.T) {
+	for _, d := range []notificationWindowData{
+		{Name: "outside", Start: "09:00", End: "17:00", Outside: "later"},
+		{Name: "day", Days: []string{"Someday"}, Start: "09:00", End: "17:00", Outside: "drop"},
+		{Name: "time", Start: "9am", End: "17:00", Outside: "drop"},
+		{Name: "empty", Start: "09:00", End: "09:00", Outside: "drop"},
+	} {
+		if _, err := newNotificationWindow(d); err == nil {
+			t.Errorf("expected window %s to be rejected", d.Name)
+		}
+	}
+	windows := []*notificationWindow{testWindow(t, "drop")}
+	if w, _ := windowFor(windows, "", "Notice"); w == nil {
+		t.Error("Notices should get the business hours window")
+	}
+	if w, _ := windowFor(windows, "", "Alert"); w != nil {
+		t.Error("Alerts shouldn't get a window")
+	}
+	if _, err := windowFor(windows, "weekends", "Alert"); err == nil {
+		t.Error("expected an unknown window to be an error")
+	}
+}
+
+func Test_holdNotification(t *testing.T) {
+	q, _ := newNotificationQueue("", 1)
+	outbox = q
+	defer func() { outbox = nil }()
+	a := newAlert("disk", "disk", "Notice", 90, "above", DummyFetcher{}, "ops@example.com", "")
+	a.Status = "Failed"
+	// a Saturday
+	saturday := time.Date(2020, 7, 18, 3, 0, 0, 0, time.UTC)
+
+	a.NotifyWindow = testWindow(t, "drop")
+	if held, _ := a.holdNotification("alert", saturday); !held {
+		t.Error("expected the notification to be dropped")
+	}
+
+	a.NotifyWindow = testWindow(t, "defer")
+	held, at := a.holdNotification("alert", saturday)
+	if held || !at.Equal(a.NotifyWindow.NextOpen(saturday)) {
+		t.Errorf("expected the notification to be deferred to Monday, got %v %v", held, at)
+	}
+	queueMailAt(mailMessage{To: "ops@example.com", Subject: "later"}, at)
+	q.senders[emailChannel] = func(queuedNotification) error {
+		t.Error("a deferred notification shouldn't be sent early")
+		return nil
+	}
+	q.deliverDue(saturday)
+
+	a.NotifyWindow = testWindow(t, "digest")
+	if held, _ := a.holdNotification("alert", saturday); !held {
+		t.Error("expected the notification to go into the digest")
+	}
+	flushWindowDigests([]*notificationWindow{a.NotifyWindow}, saturday)
+	if q.Pending() != 1 {
+		t.Error("the digest shouldn't go out until the window opens")
+	}
+	flushWindowDigests([]*notificationWindow{a.NotifyWindow}, at)
+	if q.Pending() != 2 || q.pending[1].Message.To != "ops@example.com" {
+		t.Errorf("expected the digest when the window opens, got %d", q.Pending())
+	}
+}
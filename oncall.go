@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	onCallPrefix     = "oncall:"
+	onCallTimeFormat = "2006-01-02T15:04"
+	maxPageHistory   = 20
+)
+
+type onCallOverride struct {
+	Start time.Time
+	End   time.Time
+	Who   string
+}
+
+type onCallSchedule struct {
+	Name      string
+	location  *time.Location
+	rotation  []string
+	start     time.Time
+	shiftDays int
+	overrides []onCallOverride
+}
+
+// pageRecord is someone an alert notified through an on-call schedule.
+type pageRecord struct {
+	Time     time.Time
+	Schedule string
+	Who      string
+}
+
+// onCallSchedules are looked up by name when a notification goes out.
+var onCallSchedules = make(map[string]*onCallSchedule)
+
+func newOnCallSchedule(d scheduleData) (*onCallSchedule, error) {
+	s := &onCallSchedule{Name: d.Name, rotation: d.Rotation, shiftDays: d.ShiftDays}
+	if d.Name == "" {
+		return nil, errors.New("on-call schedule without a name")
+	}
+	if len(d.Rotation) == 0 {
+		return nil, fmt.Errorf("on-call schedule %s has nobody in its rotation", d.Name)
+	}
+	if s.shiftDays == 0 {
+		s.shiftDays = 7
+	}
+	if s.shiftDays < 0 {
+		return nil, fmt.Errorf("on-call schedule %s: ShiftDays can't be negative", d.Name)
+	}
+	var err error
+	if s.location, err = time.LoadLocation(d.TimeZone); err != nil {
+		return nil, fmt.Errorf("on-call schedule %s: %v", d.Name, err)
+	}
+	if s.start, err = time.ParseInLocation(onCallTimeFormat, d.Start, s.location); err != nil {
+		return nil, fmt.Errorf("on-call schedule %s: bad Start: %v", d.Name, err)
+	}
+	for _, o := range d.Overrides {
+		var ov onCallOverride
+		if ov.Start, err = time.ParseInLocation(onCallTimeFormat, o.Start, s.location); err != nil {
+			return nil, fmt.Errorf("on-call schedule %s: bad override Start: %v", d.Name, err)
+		}
+		if ov.End, err = time.ParseInLocation(onCallTimeFormat, o.End, s.location); err != nil {
+			return nil, fmt.Errorf("on-call schedule %s: bad override End: %v", d.Name, err)
+		}
+		if o.Who == "" || !ov.End.After(ov.Start) {
+			return nil, fmt.Errorf("on-call schedule %s: override %s to %s needs a Who and to end after it starts",
+				d.Name, o.Start, o.End)
+		}
+		ov.Who = o.Who
+		s.overrides = append(s.overrides, ov)
+	}
+	return s, nil
+}
+
+// loadOnCallSchedules builds the schedules in the config. They only
+// replace onCallSchedules once the collection they're part of starts.
+func loadOnCallSchedules(f configData) (map[string]*onCallSchedule, error) {
+	schedules := make(map[string]*onCallSchedule)
+	for _, d := range f.Schedules {
+		s, err := newOnCallSchedule(d)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := schedules[s.Name]; ok {
+			return nil, fmt.Errorf("duplicate on-call schedule %s", s.Name)
+		}
+		schedules[s.Name] = s
+	}
+	return schedules, nil
+}
+
+// OnCall is who's on call at t. The most recently listed override that
+// covers t wins over the rotation.
+func (s *onCallSchedule) OnCall(t time.Time) string {
+	for i := len(s.overrides) - 1; i >= 0; i-- {
+		o := s.overrides[i]
+		if !t.Before(o.Start) && t.Before(o.End) {
+			return o.Who
+		}
+	}
+	t = t.In(s.location)
+	// count calendar days in the schedule's time zone, so handoffs
+	// stay at the same local time across daylight saving changes
+	days := daysBetween(s.start, t)
+	handoff := time.Date(t.Year(), t.Month(), t.Day(), s.start.Hour(), s.start.Minute(), 0, 0, s.location)
+	if t.Before(handoff) {
+		days--
+	}
+	shift := int(math.Floor(float64(days) / float64(s.shiftDays)))
+	n := len(s.rotation)
+	return s.rotation[((shift%n)+n)%n]
+}
+
+func daysBetween(a, b time.Time) int {
+	da := time.Date(a.Year(), a.Month(), a.Day(), 0, 0, 0, 0, time.UTC)
+	db := time.Date(b.Year(), b.Month(), b.Day(), 0, 0, 0, 0, time.UTC)
+	return int(db.Sub(da).Hours() / 24)
+}
+
+func onCallNames(list string) []string {
+	var names []string
+	for _, part := range strings.Split(list, ",") {
+		part = strings.TrimSpace(part)
+		if strings.HasPrefix(part, onCallPrefix) {
+			names = append(names, strings.TrimPrefix(part, onCallPrefix))
+		}
+	}
+	return names
+}
+
+// checkOnCallReferences makes sure every schedule an address list
+// refers to is one of schedules.
+func checkOnCallReferences(schedules map[string]*onCallSchedule, lists ...string) error {
+	for _, list := range lists {
+		for _, name := range onCallNames(list) {
+			if _, ok := schedules[name]; !ok {
+				return fmt.Errorf("unknown on-call schedule %s", name)
+			}
+		}
+	}
+	return nil
+}
+
+// resolveOnCall replaces each "oncall:<name>" in an address list with
+// whoever's on call for that schedule at t.
+func resolveOnCall(list string, t time.Time) (string, []pageRecord) {
+	if !strings.Contains(list, onCallPrefix) {
+		return list, nil
+	}
+	var parts []string
+	var pages []pageRecord
+	for _, part := range strings.Split(list, ",") {
+		part = strings.TrimSpace(part)
+		if !strings.HasPrefix(part, onCallPrefix) {
+			if part != "" {
+				parts = append(parts, part)
+			}
+			continue
+		}
+		name := strings.TrimPrefix(part, onCallPrefix)
+		s, ok := onCallSchedules[name]
+		if !ok {
+			log.WithFields(log.Fields{"schedule": name}).Error("unknown on-call schedule")
+			continue
+		}
+		who := s.OnCall(t)
+		parts = append(parts, who)
+		pages = append(pages, pageRecord{Time: t, Schedule: name, Who: who})
+	}
+	return strings.Join(parts, ", "), pages
+}
+
+// notificationRecipients is the alert's To, Cc and Bcc with on-call
+// schedules resolved for a notification going out now.
+func (a *alert) notificationRecipients(now time.Time) (mailMessage, []pageRecord) {
+	var pages, p []pageRecord
+	m := mailMessage{From: emailFrom}
+	m.To, p = resolveOnCall(a.EmailTo, now)
+	pages = append(pages, p...)
+	m.Cc, p = resolveOnCall(a.EmailCc, now)
+	pages = append(pages, p...)
+	m.Bcc, p = resolveOnCall(a.EmailBcc, now)
+	pages = append(pages, p...)
+	return m, pages
+}
+
+// onCallNow is who's on call for each schedule, sorted by schedule.
+func onCallNow(schedules map[string]*onCallSchedule, now time.Time) []pageRecord {
+	var current []pageRecord
+	for name, s := range schedules {
+		current = append(current, pageRecord{Time: now, Schedule: name, Who: s.OnCall(now)})
+	}
+	sort.Slice(current, func(i, j int) bool { return current[i].Schedule < current[j].Schedule })
+	return current
+}
+
+// recordPages keeps a short history of who the alert paged.
+func (a *alert) recordPages(pages []pageRecord) {
+	a.Pages = append(a.Pages, pages...)
+	if len(a.Pages) > maxPageHistory {
+		a.Pages = a.Pages[len(a.Pages)-maxPageHistory:]
+	}
+}
+
+// LastPaged is the most recent page, for the dashboard.
+func (a alert) LastPaged() *pageRecord {
+	if len(a.Pages) == 0 {
+		return nil
+	}
+	return &a.Pages[len(a.Pages)-1]
+}
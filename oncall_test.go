@@ -0,0 +1,125 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSchedule(t *testing.T) *onCallSchedule {
+	s, err := newOnCallSchedule(scheduleData{
+		Name:     "ops",
+		TimeZone: "America/New_York",
+		Rotation: []string{"alice@example.com", "bob@example.com", "carol@example.com"},
+		Start:    "2020-01-06T09:00",
+		Overrides: []overrideData{
+			{Start: "2020-01-15T00:00", End: "2020-01-16T00:00", Who: "dave@example.com"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func Test_onCallRotation(t *testing.T) {
+	s := testSchedule(t)
+	ny := s.location
+	for _, c := range []struct {
+		when time.Time
+		who  string
+	}{
+		{time.Date(2020, 1, 6, 9, 0, 0, 0, ny), "alice@example.com"},
+		{time.Date(2020, 1, 13, 8, 59, 0, 0, ny), "alice@example.com"},
+		{time.Date(2020, 1, 13, 9, 0, 0, 0, ny), "bob@example.com"},
+		{time.Date(2020, 1, 15, 12, 0, 0, 0, ny), "dave@example.com"},
+		{time.Date(2020, 1, 20, 9, 0, 0, 0, ny), "carol@example.com"},
+		{time.Date(2020, 1, 27, 9, 0, 0, 0, ny), "alice@example.com"},
+		// before the schedule starts, counting backwards
+		{time.Date(2020, 1, 5, 9, 0, 0, 0, ny), "carol@example.com"},
+		// handoff stays at 9am local across the switch to daylight time
+		{time.Date(2020, 3, 9, 8, 59, 0, 0, ny), "carol@example.com"},
+		{time.Date(2020, 3, 9, 9, 0, 0, 0, ny), "alice@example.com"},
+	} {
+		if who := s.OnCall(c.when.UTC()); who != c.who {
+			t.Errorf("%v: expected %s, got %s", c.when, c.who, who)
+		}
+	}
+}
+
+func Test_newOnCallScheduleErrors(t *testing.T) {
+	for _, d := range []scheduleData{
+		{Name: "none", Start: "2020-01-06T09:00"},
+		{Name: "tz", TimeZone: "Nowhere/Special", Rotation: []string{"a"}, Start: "2020-01-06T09:00"},
+		{Name: "start", Rotation: []string{"a"}, Start: "Monday"},
+		{Name: "override", Rotation: []string{"a"}, Start: "2020-01-06T09:00",
+			Overrides: []overrideData{{Start: "2020-01-07T00:00", End: "2020-01-06T00:00", Who: "b"}}},
+	} {
+		if _, err := newOnCallSchedule(d); err == nil {
+			t.Errorf("expected schedule %s to be rejected", d.Name)
+		}
+	}
+}
+
+func Test_resolveOnCall(t *testing.T) {
+	onCallSchedules = map[string]*onCallSchedule{"ops": testSchedule(t)}
+	defer func() { onCallSchedules = make(map[string]*onCallSchedule) }()
+
+	if err := checkOnCallReferences(onCallSchedules, "team@example.com, oncall:ops"); err != nil {
+		t.Error(err)
+	}
+	if err := checkOnCallReferences(onCallSchedules, "oncall:dba"); err == nil {
+		t.Error("expected an unknown schedule to be an error")
+	}
+
+	when := time.Date(2020, 1, 14, 12, 0, 0, 0, time.UTC)
+	list, pages := resolveOnCall("team@example.com, oncall:ops", when)
+	if list != "team@example.com, bob@example.com" {
+		t.Errorf("unexpected list: %s", list)
+	}
+	if len(pages) != 1 || pages[0].Who != "bob@example.com" || pages[0].Schedule != "ops" {
+		t.Errorf("unexpected pages: %v", pages)
+	}
+
+	q, _ := newNotificationQueue("", 1)
+	outbox = q
+	defer func() { outbox = nil }()
+	a := newAlert("disk", "disk", "", 90, "above", DummyFetcher{}, "oncall:ops", "")
+	a.Status = "Failed"
+	a.SendAlert()
+	if q.Pending() != 1 || len(a.Pages) != 1 {
+		t.Fatalf("expected one page, got %d queued and %v", q.Pending(), a.Pages)
+	}
+	if q.pending[0].Message.To != a.Pages[0].Who || a.LastPaged().Schedule != "ops" {
+		t.Errorf("the alert should go to whoever was paged: %s, %v", q.pending[0].Message.To, a.Pages)
+	}
+}
+
+func Test_globalOnCall(t *testing.T) {
+	onCallSchedules = map[string]*onCallSchedule{"ops": testSchedule(t)}
+	defer func() { onCallSchedules = make(map[string]*onCallSchedule) }()
+	q, _ := newNotificationQueue("", 1)
+	outbox = q
+	defer func() { outbox = nil }()
+
+	smtpEmailer{}.Throttled(20, 10, "team@example.com, oncall:ops")
+	to := q.pending[0].Message.To
+	if strings.Contains(to, "oncall:") || !strings.HasPrefix(to, "team@example.com, ") {
+		t.Errorf("the throttled message should go to whoever's on call, got %q", to)
+	}
+
+	reportSettings = &reportConfig{Schedule: reportSchedule{Daily: true, Hour: 9}, To: "oncall:ops"}
+	defer func() { reportSettings = nil }()
+	ac := newAlertsCollection(smtpEmailer{})
+	ac.nextReport = time.Now().Add(-time.Minute)
+	ac.sendReportIfDue(time.Now())
+	if to := q.pending[1].Message.To; strings.Contains(to, "oncall:") || to == "" {
+		t.Errorf("the report should go to whoever's on call, got %q", to)
+	}
+
+	for _, c := range []config{{EmailTo: "oncall:nobody"}, {EmailTo: "ops@example.com", ReportTo: "oncall:nobody"}} {
+		if _, err := buildAlertsCollection(configData{}, c); err == nil {
+			t.Errorf("expected an unknown schedule in %q %q to be an error", c.EmailTo, c.ReportTo)
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/textproto"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Notifications go through the outbox rather than straight to the mail
+// server, so a server that's down or slow neither loses them nor holds
+// up checking. A failed send backs off its whole channel exponentially;
+// a notification that keeps failing, or that the server refuses
+// outright, becomes a dead letter shown on the dashboard. The queue is
+// written to a file after every change so it survives restarts.
+
+const (
+	emailChannel    = "email"
+	webhookChannel  = "webhook"
+	outboxBaseDelay = 30 * time.Second
+	outboxMaxDelay  = 30 * time.Minute
+	maxDeadLetters  = 100
+)
+
+type queuedNotification struct {
+	ID      string
+	Channel string
+	Message mailMessage
+	// URL is where a webhook notification is posted
+	URL string
+	// NotBefore holds it back until then
+	NotBefore time.Time
+	Created   time.Time
+	Attempts  int
+	LastError string
+	// Failed is when it was given up on
+	Failed time.Time
+}
+
+// Recipients is who it was (or is still) meant for.
+func (n queuedNotification) Recipients() []string {
+	if n.Channel == webhookChannel {
+		// webhook URLs often have a token in the path
+		if u, err := url.Parse(n.URL); err == nil {
+			return []string{"webhook at " + u.Host}
+		}
+		return []string{"webhook"}
+	}
+	return n.Message.recipients()
+}
+
+type channelState struct {
+	Failures int
+	RetryAt  time.Time
+}
+
+type notificationQueue struct {
+	file        string
+	maxAttempts int
+	senders     map[string]func(queuedNotification) error
+
+	mu       sync.Mutex
+	pending  []*queuedNotification
+	dead     []*queuedNotification
+	channels map[string]*channelState
+	nextID   int
+	wake     chan struct{}
+}
+
+// what's saved to the queue file
+type outboxFile struct {
+	Pending []*queuedNotification
+	Dead    []*queuedNotification
+}
+
+var outbox *notificationQueue
+
+// newNotificationQueue picks up whatever was left in file. An empty file
+// name keeps the queue in memory only.
+func newNotificationQueue(file string, maxAttempts int) (*notificationQueue, error) {
+	if maxAttempts == 0 {
+		maxAttempts = 10
+	}
+	q := &notificationQueue{
+		file:        file,
+		maxAttempts: maxAttempts,
+		senders: map[string]func(queuedNotification) error{
+			emailChannel:   func(n queuedNotification) error { return sendMail(n.Message) },
+			webhookChannel: func(n queuedNotification) error { return postWebhook(n.URL, n.Message) },
+		},
+		channels: make(map[string]*channelState),
+		wake:     make(chan struct{}, 1),
+	}
+	if file == "" {
+		return q, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved outboxFile
+	if err = json.Unmarshal(b, &saved); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	q.pending = saved.Pending
+	q.dead = saved.Dead
+	q.nextID = len(q.pending) + len(q.dead)
+	if len(q.pending) > 0 {
+		log.WithFields(log.Fields{"queued": len(q.pending)}).Info("resuming queued notifications")
+	}
+	return q, nil
+}
+
+// queueMail hands m to the outbox, or sends it right away if there
+// isn't one.
+func queueMail(m mailMessage) {
+	if outbox == nil {
+		sendMail(m)
+		return
+	}
+	outbox.Enqueue(emailChannel, m)
+}
+
+// queueMailAt is queueMail, holding the message back until at. A zero
+// at means now.
+func queueMailAt(m mailMessage, at time.Time) {
+	if at.IsZero() || outbox == nil {
+		queueMail(m)
+		return
+	}
+	outbox.enqueueAt(emailChannel, "", m, at)
+}
+
+// queueWebhook is queueMail for the webhook channel.
+func queueWebhook(url string, m mailMessage) {
+	if outbox == nil {
+		postWebhook(url, m)
+		return
+	}
+	outbox.enqueue(webhookChannel, url, m)
+}
+
+func (q *notificationQueue) Enqueue(channel string, m mailMessage) {
+	q.enqueue(channel, "", m)
+}
+
+func (q *notificationQueue) enqueue(channel, url string, m mailMessage) {
+	q.enqueueAt(channel, url, m, time.Time{})
+}
+
+func (q *notificationQueue) enqueueAt(channel, url string, m mailMessage, at time.Time) {
+	if channel == emailChannel && len(m.recipients()) == 0 {
+		log.WithFields(log.Fields{"Subject": m.Subject}).Error("no recipients")
+		return
+	}
+	q.mu.Lock()
+	now := time.Now()
+	q.nextID++
+	q.pending = append(q.pending, &queuedNotification{
+		ID:        fmt.Sprintf("%d.%d", now.UnixNano(), q.nextID),
+		Channel:   channel,
+		Message:   m,
+		URL:       url,
+		Created:   now,
+		NotBefore: at,
+	})
+	q.save()
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers queued notifications until ctx is cancelled.
+func (q *notificationQueue) Run(ctx context.Context) {
+	for {
+		timer := time.NewTimer(q.deliverDue(time.Now()))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-q.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// deliverDue sends everything queued on channels that aren't backing
+// off, oldest first, and says how long until it's worth trying again.
+func (q *notificationQueue) deliverDue(now time.Time) time.Duration {
+	for {
+		n := q.next(now)
+		if n == nil {
+			break
+		}
+		var err error
+		if send, ok := q.senders[n.Channel]; ok {
+			err = send(*n)
+		} else {
+			err = fmt.Errorf("unknown channel %q", n.Channel)
+		}
+		q.finish(n, err, now)
+	}
+	return q.untilRetry(now)
+}
+
+func (q *notificationQueue) next(now time.Time) *queuedNotification {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, n := range q.pending {
+		if !q.channel(n.Channel).RetryAt.After(now) && !n.NotBefore.After(now) {
+			return n
+		}
+	}
+	return nil
+}
+
+func (q *notificationQueue) untilRetry(now time.Time) time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	wait := time.Hour
+	for _, n := range q.pending {
+		at := q.channel(n.Channel).RetryAt
+		if n.NotBefore.After(at) {
+			at = n.NotBefore
+		}
+		if d := at.Sub(now); d < wait {
+			wait = d
+		}
+	}
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return wait
+}
+
+// channel must be called with mu held.
+func (q *notificationQueue) channel(name string) *channelState {
+	ch, ok := q.channels[name]
+	if !ok {
+		ch = &channelState{}
+		q.channels[name] = ch
+	}
+	return ch
+}
+
+// finish records the outcome of a send. Recipients the server refused
+// permanently are dead-lettered on their own; the rest are retried.
+func (q *notificationQueue) finish(n *queuedNotification, err error, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	defer q.save()
+	ch := q.channel(n.Channel)
+	n.Attempts++
+	if err == nil {
+		ch.Failures = 0
+		q.remove(n)
+		return
+	}
+
+	if de, ok := err.(deliveryError); ok {
+		// the server is up and took the message for someone
+		ch.Failures = 0
+		var permanent, temporary []string
+		for rcpt, e := range de.Failed {
+			if permanentError(e) {
+				permanent = append(permanent, rcpt)
+			} else {
+				temporary = append(temporary, rcpt)
+			}
+		}
+		sort.Strings(permanent)
+		sort.Strings(temporary)
+		if len(permanent) > 0 {
+			d := *n
+			d.Message.Envelope = permanent
+			q.kill(&d, deliveryError{Failed: failedSubset(de, permanent)}, now)
+		}
+		if len(temporary) == 0 {
+			q.remove(n)
+			return
+		}
+		n.Message.Envelope = temporary
+		err = deliveryError{Failed: failedSubset(de, temporary)}
+	}
+
+	log.WithFields(log.Fields{
+		"subject":  n.Message.Subject,
+		"attempts": n.Attempts,
+		"error":    err,
+	}).Warn("notification not delivered")
+	if permanentError(err) || n.Attempts >= q.maxAttempts {
+		q.remove(n)
+		q.kill(n, err, now)
+		return
+	}
+	n.LastError = err.Error()
+	ch.Failures++
+	ch.RetryAt = now.Add(outboxBackoff(ch.Failures))
+}
+
+func failedSubset(de deliveryError, rcpts []string) map[string]error {
+	failed := make(map[string]error)
+	for _, r := range rcpts {
+		failed[r] = de.Failed[r]
+	}
+	return failed
+}
+
+// outboxBackoff doubles with each consecutive failure.
+func outboxBackoff(failures int) time.Duration {
+	d := outboxBaseDelay
+	for i := 1; i < failures && d < outboxMaxDelay; i++ {
+		d *= 2
+	}
+	if d > outboxMaxDelay {
+		d = outboxMaxDelay
+	}
+	return d
+}
+
+// permanentError is a 5xx reply from the mail server, or a 4xx from a
+// webhook; trying again won't help.
+func permanentError(err error) bool {
+	if te, ok := err.(*textproto.Error); ok {
+		return te.Code >= 500
+	}
+	if we, ok := err.(webhookError); ok {
+		return we.permanent()
+	}
+	if de, ok := err.(deliveryError); ok {
+		for _, e := range de.Failed {
+			if !permanentError(e) {
+				return false
+			}
+		}
+		return len(de.Failed) > 0
+	}
+	return false
+}
+
+// remove and kill must be called with mu held.
+func (q *notificationQueue) remove(n *queuedNotification) {
+	for i, p := range q.pending {
+		if p == n {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+func (q *notificationQueue) kill(n *queuedNotification, err error, now time.Time) {
+	n.LastError = err.Error()
+	n.Failed = now
+	log.WithFields(log.Fields{
+		"subject":    n.Message.Subject,
+		"recipients": n.Message.recipients(),
+		"error":      err,
+	}).Error("giving up on notification")
+	q.dead = append(q.dead, n)
+	if len(q.dead) > maxDeadLetters {
+		q.dead = q.dead[len(q.dead)-maxDeadLetters:]
+	}
+}
+
+// save must be called with mu held. The file is replaced in one go so
+// a crash part way through never leaves half a queue.
+func (q *notificationQueue) save() {
+	if q.file == "" {
+		return
+	}
+	b, err := json.Marshal(outboxFile{Pending: q.pending, Dead: q.dead})
+	if err == nil {
+		tmp := q.file + ".tmp"
+		if err = ioutil.WriteFile(tmp, b, 0600); err == nil {
+			err = os.Rename(tmp, q.file)
+		}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"file":  q.file,
+			"error": fmt.Sprintf("%v", err),
+		}).Error("couldn't save notification queue")
+	}
+}
+
+// Pending is how many notifications are waiting to go out.
+func (q *notificationQueue) Pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// DeadLetters are the notifications that were given up on, newest first.
+func (q *notificationQueue) DeadLetters() []queuedNotification {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	dead := make([]queuedNotification, 0, len(q.dead))
+	for i := len(q.dead) - 1; i >= 0; i-- {
+		dead = append(dead, *q.dead[i])
+	}
+	return dead
+}
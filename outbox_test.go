@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"net/textproto"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// scriptedSender fails with each error in turn, then succeeds.
+type scriptedSender struct {
+	errs []error
+	sent []mailMessage
+}
+
+func (s *scriptedSender) send(m mailMessage) error {
+	s.sent = append(s.sent, m)
+	if len(s.errs) == 0 {
+		return nil
+	}
+	err := s.errs[0]
+	s.errs = s.errs[1:]
+	return err
+}
+
+func newTestQueue(t *testing.T, file string, s *scriptedSender) *notificationQueue {
+	q, err := newNotificationQueue(file, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.senders[emailChannel] = func(n queuedNotification) error { return s.send(n.Message) }
+	return q
+}
+
+var testNotification = mailMessage{From: "hound@example.com", To: "ops@example.com, dev@example.com", Subject: "[ALERT] x"}
+
+func Test_outboxRetriesWithBackoff(t *testing.T) {
+	s := &scriptedSender{errs: []error{errors.New("connection refused"), errors.New("connection refused")}}
+	q := newTestQueue(t, "", s)
+	q.Enqueue(emailChannel, testNotification)
+	q.Enqueue(emailChannel, testNotification)
+
+	now := time.Now()
+	if wait := q.deliverDue(now); wait != outboxBaseDelay {
+		t.Errorf("expected to wait %v, got %v", outboxBaseDelay, wait)
+	}
+	if len(s.sent) != 1 || q.Pending() != 2 {
+		t.Fatalf("a failure should hold up the channel: sent %d, pending %d", len(s.sent), q.Pending())
+	}
+
+	now = now.Add(outboxBaseDelay)
+	if wait := q.deliverDue(now); wait != 2*outboxBaseDelay {
+		t.Errorf("expected the backoff to double, got %v", wait)
+	}
+
+	q.deliverDue(now.Add(2 * outboxBaseDelay))
+	if q.Pending() != 0 || len(s.sent) != 4 {
+		t.Errorf("expected everything sent: sent %d, pending %d", len(s.sent), q.Pending())
+	}
+	if len(q.DeadLetters()) != 0 {
+		t.Error("nothing should be dead-lettered")
+	}
+}
+
+func Test_outboxDeadLetters(t *testing.T) {
+	fail := errors.New("connection refused")
+	s := &scriptedSender{errs: []error{fail, fail, fail}}
+	q := newTestQueue(t, "", s)
+	q.Enqueue(emailChannel, testNotification)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		now = now.Add(outboxMaxDelay)
+		q.deliverDue(now)
+	}
+	dead := q.DeadLetters()
+	if q.Pending() != 0 || len(dead) != 1 {
+		t.Fatalf("expected one dead letter, pending %d dead %d", q.Pending(), len(dead))
+	}
+	if dead[0].Attempts != 3 || dead[0].LastError != "connection refused" {
+		t.Errorf("unexpected dead letter: %+v", dead[0])
+	}
+
+	// a 5xx is given up on straight away
+	s.errs = []error{&textproto.Error{Code: 554, Msg: "rejected"}}
+	q.Enqueue(emailChannel, testNotification)
+	q.deliverDue(now.Add(outboxMaxDelay))
+	if len(q.DeadLetters()) != 2 {
+		t.Error("expected a permanent failure to be dead-lettered")
+	}
+}
+
+func Test_outboxPartialDelivery(t *testing.T) {
+	s := &scriptedSender{errs: []error{deliveryError{Failed: map[string]error{
+		"ops@example.com": &textproto.Error{Code: 550, Msg: "no such user"},
+		"dev@example.com": &textproto.Error{Code: 451, Msg: "try later"},
+	}}}}
+	m := testNotification
+	m.To = "ops@example.com, dev@example.com, boss@example.com"
+	q := newTestQueue(t, "", s)
+	q.Enqueue(emailChannel, m)
+	now := time.Now()
+	q.deliverDue(now)
+
+	dead := q.DeadLetters()
+	if len(dead) != 1 || len(dead[0].Recipients()) != 1 || dead[0].Recipients()[0] != "ops@example.com" {
+		t.Fatalf("expected just ops to be dead-lettered, got %+v", dead)
+	}
+	q.deliverDue(now.Add(outboxBaseDelay))
+	if q.Pending() != 0 {
+		t.Fatal("expected the retry to go through")
+	}
+	retried := s.sent[len(s.sent)-1].recipients()
+	if len(retried) != 1 || retried[0] != "dev@example.com" {
+		t.Errorf("expected the retry to go to dev only, got %v", retried)
+	}
+}
+
+func Test_outboxPersists(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "queue.json")
+	s := &scriptedSender{errs: []error{errors.New("connection refused")}}
+	q := newTestQueue(t, file, s)
+	q.Enqueue(emailChannel, testNotification)
+	q.deliverDue(time.Now())
+
+	s = &scriptedSender{}
+	q = newTestQueue(t, file, s)
+	if q.Pending() != 1 {
+		t.Fatalf("expected the queued notification to survive, got %d", q.Pending())
+	}
+	q.deliverDue(time.Now())
+	if len(s.sent) != 1 || s.sent[0].Subject != testNotification.Subject {
+		t.Errorf("expected the saved notification to be sent, got %v", s.sent)
+	}
+	if q = newTestQueue(t, file, s); q.Pending() != 0 {
+		t.Error("the sent notification should be gone from the file")
+	}
+}
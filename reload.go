@@ -0,0 +1,120 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// When the config is reloaded, every alert is built again from
+// scratch. Alerts whose Hash hasn't changed pick up where the old ones
+// left off, so a reload doesn't forget what's failing, re-announce it,
+// or reset its throttling.
+
+// carryOver copies the state of old's alerts into the matching ones in
+// ac. old must have stopped running.
+func (ac *alertsCollection) carryOver(old *alertsCollection) {
+	for _, a := range ac.alerts {
+		if o, ok := old.alertsByHash[a.Hash()]; ok {
+			a.takeState(o)
+		}
+	}
+	// the next report covers everything since the last one, but it's
+	// worked out again if the schedule changed
+	ac.lastReport = old.lastReport
+	if reportSettings != nil && reportSettings.Schedule == old.reportSchedule {
+		ac.nextReport, ac.reportSchedule = old.nextReport, old.reportSchedule
+	}
+	ac.carryOverWindowDigests(old, time.Now())
+	if escalations != nil {
+		escalations.prune(ac)
+	}
+}
+
+// carryOverWindowDigests keeps what's been collected for a window
+// that's still digesting after the reload, and sends on what was
+// collected for one that isn't.
+func (ac *alertsCollection) carryOverWindowDigests(old *alertsCollection, now time.Time) {
+	digesting := make(map[string]*notificationWindow)
+	for _, w := range ac.windows {
+		if w.digest != nil {
+			digesting[w.Name] = w
+		}
+	}
+	for _, o := range old.windows {
+		if o.digest == nil {
+			continue
+		}
+		if w, ok := digesting[o.Name]; ok {
+			w.digest = o.digest
+			continue
+		}
+		for _, m := range o.digest.Flush(now) {
+			queueMail(m)
+		}
+	}
+}
+
+// takeState copies everything about o that changes as it's checked.
+func (a *alert) takeState(o *alert) {
+	a.Status = o.Status
+	a.PreviousStatus = o.PreviousStatus
+	a.Message = o.Message
+	a.Value = o.Value
+	a.Baseline = o.Baseline
+	a.Deviation = o.Deviation
+	a.Series = o.Series
+	a.Backoff = o.Backoff
+	a.LastAlerted = o.LastAlerted
+	a.IncidentStart = o.IncidentStart
+	a.incidentMessages = o.incidentMessages
+	a.suppressedIncident = o.suppressedIncident
+	a.NextCheck = o.NextCheck
+	a.Fired = o.Fired
+	a.FailingFor = o.FailingFor
+	a.historyChecked = o.historyChecked
+	a.Pages = o.Pages
+}
+
+// alertChanges compares the alerts in old and ac by name.
+func (ac *alertsCollection) alertChanges(old *alertsCollection) (added, removed, changed []string) {
+	for name, d := range ac.definitions {
+		o, ok := old.definitions[name]
+		switch {
+		case !ok:
+			added = append(added, name)
+		case !reflect.DeepEqual(o, d):
+			changed = append(changed, name)
+		}
+	}
+	for name := range old.definitions {
+		if _, ok := ac.definitions[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed
+}
+
+// logAlertChanges says what a reload did to the alerts.
+func logAlertChanges(old, ac *alertsCollection) {
+	added, removed, changed := ac.alertChanges(old)
+	for _, name := range added {
+		log.WithFields(log.Fields{"name": name}).Info("alert added")
+	}
+	for _, name := range removed {
+		log.WithFields(log.Fields{"name": name}).Info("alert removed")
+	}
+	for _, name := range changed {
+		log.WithFields(log.Fields{"name": name}).Info("alert changed")
+	}
+	log.WithFields(log.Fields{
+		"added":   len(added),
+		"removed": len(removed),
+		"changed": len(changed),
+	}).Info("reloaded alerts")
+}
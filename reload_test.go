@@ -0,0 +1,170 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func buildTestCollection(t *testing.T, alerts ...alertData) *alertsCollection {
+	ac, err := buildAlertsCollection(configData{Alerts: alerts}, config{EmailTo: "ops@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ac
+}
+
+func Test_carryOver(t *testing.T) {
+	old := buildTestCollection(t,
+		alertData{Name: "a", Metric: "a", Threshold: 1, Direction: "above"},
+		alertData{Name: "b", Metric: "b", Threshold: 1, Direction: "above"},
+		alertData{Name: "c", Metric: "c", Threshold: 1, Direction: "above"},
+	)
+	failedAt := time.Now().Add(-time.Hour)
+	for _, a := range old.alerts {
+		a.Status, a.PreviousStatus, a.Backoff, a.LastAlerted = "Failed", "Failed", 2, failedAt
+		a.NextCheck = failedAt
+	}
+	savedReport := reportSettings
+	defer func() { reportSettings = savedReport }()
+	weekly := reportSchedule{Weekday: time.Monday, Hour: 9}
+	reportSettings = &reportConfig{Schedule: weekly, To: "ops@example.com"}
+	old.lastReport, old.nextReport, old.reportSchedule = failedAt.Add(-time.Hour), failedAt, weekly
+
+	ac := buildTestCollection(t,
+		// unchanged apart from who it goes to
+		alertData{Name: "a", Metric: "a", Threshold: 1, Direction: "above", EmailTo: "dev@example.com"},
+		// a different threshold starts afresh
+		alertData{Name: "b", Metric: "b", Threshold: 2, Direction: "above"},
+		alertData{Name: "d", Metric: "d", Threshold: 1, Direction: "above"},
+	)
+	ac.carryOver(old)
+	a := ac.byName("a")
+	if a.Status != "Failed" || a.Backoff != 2 || !a.LastAlerted.Equal(failedAt) || a.EmailTo != "dev@example.com" {
+		t.Errorf("state should carry over: %+v", a)
+	}
+	if b := ac.byName("b"); b.Status != "Pending" || b.Backoff != 0 {
+		t.Errorf("a changed alert should start afresh: %+v", b)
+	}
+	if !ac.nextReport.Equal(failedAt) || !ac.lastReport.Equal(old.lastReport) {
+		t.Error("the report schedule should carry over")
+	}
+
+	// only the alerts without a place in the schedule get one
+	now := time.Now()
+	ac.scheduleInitial(now)
+	if !a.NextCheck.Equal(failedAt) || ac.byName("d").NextCheck.Before(now) {
+		t.Error("wrong schedule after a reload")
+	}
+
+	// a new report schedule means working out when the next one is due,
+	// but it still covers everything since the last
+	reportSettings = &reportConfig{Schedule: reportSchedule{Daily: true, Hour: 9}, To: "ops@example.com"}
+	rescheduled := buildTestCollection(t)
+	rescheduled.carryOver(old)
+	if !rescheduled.nextReport.IsZero() || !rescheduled.lastReport.Equal(old.lastReport) {
+		t.Errorf("the next report should be worked out again: last %v, next %v", rescheduled.lastReport, rescheduled.nextReport)
+	}
+	rescheduled.sendReportIfDue(now)
+	if !rescheduled.nextReport.Equal(reportSettings.Schedule.next(now)) || !rescheduled.lastReport.Equal(old.lastReport) {
+		t.Errorf("wrong report schedule after it changed: last %v, next %v", rescheduled.lastReport, rescheduled.nextReport)
+	}
+
+	added, removed, changed := ac.alertChanges(old)
+	if strings.Join(added, ",") != "d" || strings.Join(removed, ",") != "c" || strings.Join(changed, ",") != "a,b" {
+		t.Errorf("wrong changes: added %v, removed %v, changed %v", added, removed, changed)
+	}
+}
+
+func Test_carryOverWindowDigests(t *testing.T) {
+	q, _ := newNotificationQueue("", 1)
+	outbox = q
+	defer func() { outbox = nil }()
+	window := func(name, outside string) notificationWindowData {
+		return notificationWindowData{Name: name, Start: "09:00", End: "17:00", Outside: outside}
+	}
+	old, err := buildAlertsCollection(configData{NotificationWindows: []notificationWindowData{
+		window("kept", "digest"), window("dropped", "digest"), window("deferred", "digest"),
+	}}, config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range old.windows {
+		w.digest.Add([]string{w.Name + "@example.com"}, digestEntry{Name: "disk"})
+	}
+	ac, err := buildAlertsCollection(configData{NotificationWindows: []notificationWindowData{
+		window("kept", "digest"), window("deferred", "defer"),
+	}}, config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac.carryOverWindowDigests(old, time.Now())
+	if ac.windows[0].digest != old.windows[0].digest {
+		t.Error("a window that's still digesting should keep what it's collected")
+	}
+	var sent []string
+	for _, n := range q.pending {
+		sent = append(sent, n.Message.To)
+	}
+	if strings.Join(sent, ",") != "dropped@example.com,deferred@example.com" {
+		t.Errorf("the digests of windows that are gone or don't digest any more should be sent, got %v", sent)
+	}
+}
+
+func Test_prepareReload(t *testing.T) {
+	savedSchedules, savedTemplates := onCallSchedules, notificationTemplates
+	defer func() {
+		applySettings(config{})
+		onCallSchedules = savedSchedules
+	}()
+	global := writeTempFile(t, "global.tmpl", `{{define "alert_subject"}}global {{.Alert.Name}}{{end}}`)
+	own := writeTempFile(t, "own.tmpl", `{{define "alert_body"}}own{{end}}`)
+	path := writeConfigFiles(t, map[string]string{"hound.yaml": `
+Settings:
+  EmailTo: oncall:ops
+  GraphiteFindURL: https://graphite.example.com/metrics/find/
+  NotificationTemplates: ` + global + `
+Schedules:
+  - Name: ops
+    Rotation: [alice@example.com]
+    Start: "2020-01-06T09:00"
+Alerts:
+  - Name: disk
+    Metric: disk
+    Threshold: 90
+    Direction: above
+    Templates: ` + own + `
+`})
+	c, ac, apply, err := prepareReload(path, config{QueueFile: "queue.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.QueueFile != "queue.json" {
+		t.Error("restart-only settings should be kept")
+	}
+	if onCallSchedules["ops"] != nil || notificationTemplates != savedTemplates {
+		t.Fatal("nothing global should change until the new config is applied")
+	}
+	if ac.schedules["ops"] == nil || ac.finder.base != "https://graphite.example.com/metrics/find/" {
+		t.Error("the new alerts should have the new schedules and find URL")
+	}
+	a := ac.byName("disk")
+	if s := renderTemplate(a.templates, "alert_subject", a.notificationData()); s != "global disk" {
+		t.Errorf("per-alert templates should go on top of the new global ones, got %q", s)
+	}
+	apply()
+	if notificationTemplates == savedTemplates {
+		t.Error("applying should put the new templates into effect")
+	}
+
+	// a broken config is only an error
+	path = writeConfigFiles(t, map[string]string{"hound.yaml": `
+Alerts:
+  - Name: a
+    Metric: a
+    DependsOn: [nope]
+`})
+	if _, _, _, err := prepareReload(path, c); err == nil {
+		t.Error("expected an error for an unknown dependency")
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The status report is a periodic summary for people who don't watch
+// the dashboard: what's failing now, what fired most since the last
+// report, and for how long.
+
+// reportSchedule is a time of day, on one day of the week or every day.
+type reportSchedule struct {
+	Daily   bool
+	Weekday time.Weekday
+	Hour    int
+	Minute  int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday,
+	"wed": time.Wednesday, "thu": time.Thursday, "fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseReportSchedule takes "daily 09:00" or a weekday and a time, like
+// "Mon 09:00" or "monday 9:00".
+func parseReportSchedule(s string) (reportSchedule, error) {
+	var r reportSchedule
+	fields := strings.Fields(strings.ToLower(s))
+	if len(fields) != 2 {
+		return r, fmt.Errorf("report schedule %q should be a day and a time, like \"Mon 09:00\"", s)
+	}
+	if fields[0] == "daily" {
+		r.Daily = true
+	} else {
+		day := fields[0]
+		if len(day) > 3 {
+			day = day[:3]
+		}
+		wd, ok := weekdays[day]
+		if !ok {
+			return r, fmt.Errorf("unknown day %q in report schedule", fields[0])
+		}
+		r.Weekday = wd
+	}
+	hm := strings.SplitN(fields[1], ":", 2)
+	if len(hm) != 2 {
+		return r, fmt.Errorf("bad time %q in report schedule", fields[1])
+	}
+	var err error
+	if r.Hour, err = strconv.Atoi(hm[0]); err != nil || r.Hour < 0 || r.Hour > 23 {
+		return r, fmt.Errorf("bad time %q in report schedule", fields[1])
+	}
+	if r.Minute, err = strconv.Atoi(hm[1]); err != nil || r.Minute < 0 || r.Minute > 59 {
+		return r, fmt.Errorf("bad time %q in report schedule", fields[1])
+	}
+	return r, nil
+}
+
+// next is the first scheduled time after t, in t's time zone.
+func (r reportSchedule) next(t time.Time) time.Time {
+	n := time.Date(t.Year(), t.Month(), t.Day(), r.Hour, r.Minute, 0, 0, t.Location())
+	for !n.After(t) || (!r.Daily && n.Weekday() != r.Weekday) {
+		n = n.AddDate(0, 0, 1)
+	}
+	return n
+}
+
+// reportSettings is nil unless a report is scheduled.
+var reportSettings *reportConfig
+
+type reportConfig struct {
+	Schedule reportSchedule
+	To       string
+}
+
+type reportEntry struct {
+	Name       string
+	Type       string
+	Status     string
+	Message    string
+	Value      float64
+	Fired      int
+	FailingFor time.Duration
+	AlertURL   string
+}
+
+type reportNotificationData struct {
+	Since        time.Time
+	Until        time.Time
+	Alerts       int
+	Failing      []reportEntry
+	Notices      []reportEntry
+	MostFired    []reportEntry
+	FailingFor   time.Duration
+	DashboardURL string
+}
+
+const reportMostFired = 10
+
+// recordHistory keeps the numbers for the report. It has to be called
+// after a check and before UpdateState moves Status to PreviousStatus.
+func (a *alert) recordHistory(now time.Time) {
+	if a.PreviousStatus == "Failed" && !a.historyChecked.IsZero() {
+		a.FailingFor += now.Sub(a.historyChecked)
+	}
+	if a.Status == "Failed" && a.PreviousStatus != "Failed" {
+		a.Fired++
+	}
+	a.historyChecked = now
+}
+
+func (a *alert) reportEntry() reportEntry {
+	return reportEntry{
+		Name:       a.Name,
+		Type:       a.Type,
+		Status:     a.Status,
+		Message:    a.Message,
+		Value:      roundToFourPlaces(a.Value),
+		Fired:      a.Fired,
+		FailingFor: a.FailingFor.Round(time.Second),
+		AlertURL:   a.notificationData().AlertURL,
+	}
+}
+
+func (ac *alertsCollection) reportData(since, until time.Time) reportNotificationData {
+	data := reportNotificationData{Since: since, Until: until, Alerts: len(ac.alerts), DashboardURL: dashboardURL}
+	for _, a := range ac.alerts {
+		e := a.reportEntry()
+		if a.Status == "Failed" || a.Status == "Error" {
+			if a.Type == "Notice" {
+				data.Notices = append(data.Notices, e)
+			} else {
+				data.Failing = append(data.Failing, e)
+			}
+		}
+		if a.Fired > 0 {
+			data.MostFired = append(data.MostFired, e)
+		}
+		data.FailingFor += e.FailingFor
+	}
+	sort.SliceStable(data.MostFired, func(i, j int) bool {
+		if data.MostFired[i].Fired != data.MostFired[j].Fired {
+			return data.MostFired[i].Fired > data.MostFired[j].Fired
+		}
+		return data.MostFired[i].FailingFor > data.MostFired[j].FailingFor
+	})
+	if len(data.MostFired) > reportMostFired {
+		data.MostFired = data.MostFired[:reportMostFired]
+	}
+	return data
+}
+
+// sendReportIfDue mails the report once its time has come, and starts
+// counting afresh for the next one.
+func (ac *alertsCollection) sendReportIfDue(now time.Time) {
+	if reportSettings == nil {
+		return
+	}
+	if ac.nextReport.IsZero() {
+		if ac.lastReport.IsZero() {
+			ac.lastReport = now
+		}
+		ac.nextReport = reportSettings.Schedule.next(now)
+		ac.reportSchedule = reportSettings.Schedule
+		return
+	}
+	if now.Before(ac.nextReport) {
+		return
+	}
+	data := ac.reportData(ac.lastReport, now)
+	queueMail(mailMessage{
+		From:    emailFrom,
+		To:      resolveGlobalOnCall(reportSettings.To),
+		Subject: renderTemplate(notificationTemplates, "report_subject", data),
+		Text:    renderTemplate(notificationTemplates, "report_body", data),
+	})
+	for _, a := range ac.alerts {
+		a.Fired = 0
+		a.FailingFor = 0
+	}
+	ac.lastReport = now
+	ac.nextReport = reportSettings.Schedule.next(now)
+	ac.reportSchedule = reportSettings.Schedule
+}
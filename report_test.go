@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_parseReportSchedule(t *testing.T) {
+	r, err := parseReportSchedule("Monday 09:30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Daily || r.Weekday != time.Monday || r.Hour != 9 || r.Minute != 30 {
+		t.Errorf("unexpected schedule: %+v", r)
+	}
+	if r, err = parseReportSchedule("daily 17:00"); err != nil || !r.Daily {
+		t.Errorf("unexpected daily schedule: %+v %v", r, err)
+	}
+	for _, bad := range []string{"", "Mon", "Someday 09:00", "Mon 25:00", "Mon 9"} {
+		if _, err := parseReportSchedule(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func Test_reportScheduleNext(t *testing.T) {
+	// a Wednesday
+	now := time.Date(2020, 7, 15, 10, 0, 0, 0, time.UTC)
+	weekly := reportSchedule{Weekday: time.Monday, Hour: 9}
+	if n := weekly.next(now); !n.Equal(time.Date(2020, 7, 20, 9, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected next weekly report: %v", n)
+	}
+	daily := reportSchedule{Daily: true, Hour: 9}
+	if n := daily.next(now); !n.Equal(time.Date(2020, 7, 16, 9, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected next daily report: %v", n)
+	}
+	if n := daily.next(time.Date(2020, 7, 16, 9, 0, 0, 0, time.UTC)); n.Day() != 17 {
+		t.Errorf("a report shouldn't be due again at the moment it's sent: %v", n)
+	}
+}
+
+func Test_sendReportIfDue(t *testing.T) {
+	q, _ := newNotificationQueue("", 1)
+	outbox = q
+	reportSettings = &reportConfig{Schedule: reportSchedule{Daily: true, Hour: 9}, To: "managers@example.com"}
+	defer func() {
+		outbox = nil
+		reportSettings = nil
+	}()
+
+	ac := newAlertsCollection(smtpEmailer{})
+	flaky := newAlert("flaky", "flaky", "", 10, "above", DummyFetcher{}, "ops@example.com", "")
+	disk := newAlert("disk", "disk", "Notice", 90, "above", DummyFetcher{}, "ops@example.com", "")
+	ac.addAlert(flaky)
+	ac.addAlert(disk)
+
+	start := time.Date(2020, 7, 15, 8, 0, 0, 0, time.UTC)
+	ac.sendReportIfDue(start)
+	for i, status := range []string{"Failed", "OK", "Failed", "Failed"} {
+		flaky.Status = status
+		disk.Status = "Failed"
+		now := start.Add(time.Duration(i*10) * time.Minute)
+		flaky.recordHistory(now)
+		disk.recordHistory(now)
+		flaky.PreviousStatus = flaky.Status
+		disk.PreviousStatus = disk.Status
+	}
+	if flaky.Fired != 2 || flaky.FailingFor != 20*time.Minute {
+		t.Errorf("unexpected history: fired %d, failing for %v", flaky.Fired, flaky.FailingFor)
+	}
+
+	ac.sendReportIfDue(start.Add(time.Hour - time.Second))
+	if q.Pending() != 0 {
+		t.Fatal("the report isn't due yet")
+	}
+	ac.sendReportIfDue(start.Add(time.Hour))
+	if q.Pending() != 1 {
+		t.Fatal("expected the report to be queued")
+	}
+	m := q.pending[0].Message
+	if m.To != "managers@example.com" || m.Subject != "[REPORT] Hound: 1 failing" {
+		t.Errorf("unexpected report: %s %s", m.To, m.Subject)
+	}
+	for _, s := range []string{"Failing now:\n  flaky: Failed", "flaky: 2 times, failing for 20m0s", "Notices:\n  disk: Failed"} {
+		if !strings.Contains(m.Text, s) {
+			t.Errorf("expected %q in\n%s", s, m.Text)
+		}
+	}
+	if flaky.Fired != 0 || flaky.FailingFor != 0 {
+		t.Error("history should start over after a report")
+	}
+}
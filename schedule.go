@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+func (a alert) interval() time.Duration {
+	if a.CheckInterval > 0 {
+		return a.CheckInterval
+	}
+	if checkInterval > 0 {
+		return time.Duration(checkInterval) * time.Minute
+	}
+	return time.Minute
+}
+
+func (a alert) Due(now time.Time) bool {
+	return !now.Before(a.NextCheck)
+}
+
+func (a *alert) scheduleNext(now time.Time) {
+	a.NextCheck = now.Add(a.interval())
+}
+
+// startupJitter caps how far apart the first checks after startup are
+// spread, so a restart doesn't hit graphite with every alert at once.
+var startupJitter = 30 * time.Second
+
+// scheduleInitial sets every alert up to be checked right away, with a
+// little random jitter, rather than making the dashboard wait a full
+// interval after every deploy or SIGHUP. Alerts that kept their state
+// through a reload keep their place in the schedule too.
+func (ac *alertsCollection) scheduleInitial(now time.Time) {
+	for _, a := range ac.alerts {
+		if !a.NextCheck.IsZero() {
+			continue
+		}
+		jitter := startupJitter
+		if a.interval() < jitter {
+			jitter = a.interval()
+		}
+		a.NextCheck = now.Add(time.Duration(rand.Int63n(int64(jitter) + 1)))
+	}
+}
+
+// untilNextCheck is how long the Run loop can sleep before some alert
+// is due again.
+func (ac *alertsCollection) untilNextCheck(now time.Time) time.Duration {
+	var next time.Time
+	for _, a := range ac.alerts {
+		if a.IsComposite() {
+			continue
+		}
+		if next.IsZero() || a.NextCheck.Before(next) {
+			next = a.NextCheck
+		}
+	}
+	if next.IsZero() {
+		return alert{}.interval()
+	}
+	if next.Before(now) {
+		return 0
+	}
+	return next.Sub(now)
+}
+
+// checkDue fetches every alert whose interval has elapsed and returns
+// them, along with the composites, which are re-evaluated whenever any
+// alert was checked.
+func (ac *alertsCollection) checkDue(now time.Time) []*alert {
+	var due []*alert
+	for _, a := range ac.alerts {
+		if a.IsComposite() || !a.Due(now) {
+			continue
+		}
+		a.CheckMetric()
+		a.scheduleNext(now)
+		due = append(due, a)
+	}
+	if len(due) == 0 {
+		return due
+	}
+	for _, a := range ac.alerts {
+		if a.IsComposite() {
+			a.evaluateComposite()
+			due = append(due, a)
+		}
+	}
+	return due
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// CountingFetcher always returns the same raw body and counts the
+// requests made for each URL.
+type CountingFetcher struct {
+	body  string
+	calls map[string]int
+}
+
+func (c *CountingFetcher) Get(url string) (*http.Response, error) {
+	c.calls[url]++
+	return &http.Response{Status: "200 OK",
+		Body: ioutil.NopCloser(strings.NewReader(c.body))}, nil
+}
+
+func Test_interval(t *testing.T) {
+	a := newAlert("foo", "foo", "", 10, "above", DummyFetcher{}, "test@example.com", "")
+	if a.interval() != time.Minute {
+		t.Error("expected a minute when nothing is configured")
+	}
+	a.CheckInterval = time.Hour
+	if a.interval() != time.Hour {
+		t.Error("expected the per-alert interval")
+	}
+}
+
+func Test_AlertWindow(t *testing.T) {
+	a := newAlert("foo", "foo", "", 10, "above", DummyFetcher{}, "test@example.com", "")
+	a.Window = "2hours"
+	if a.URL() != "?target=keepLastValue(foo)&format=raw&from=-2hours" {
+		t.Error("wrong value:", a.URL())
+	}
+}
+
+func Test_checkDue(t *testing.T) {
+	f := &CountingFetcher{body: "foo,1,2,60|1,1", calls: make(map[string]int)}
+	ac := newAlertsCollection(DummyEmailer{})
+	fast := newAlert("fast", "fast", "", 10, "above", f, "test@example.com", "")
+	slow := newAlert("slow", "slow", "", 10, "above", f, "test@example.com", "")
+	slow.CheckInterval = time.Hour
+	ac.addAlert(fast)
+	ac.addAlert(slow)
+
+	now := time.Now()
+	ac.scheduleInitial(now)
+	if d := ac.untilNextCheck(now); d > startupJitter {
+		t.Error("expected to wake within the startup jitter", d)
+	}
+	// both get their first check straight away
+	ac.checkDue(now.Add(startupJitter))
+	now = now.Add(startupJitter)
+	for i := 1; i <= 5; i++ {
+		ac.checkDue(now.Add(time.Duration(i) * time.Minute))
+	}
+	if f.calls[fast.URL()] != 6 || f.calls[slow.URL()] != 1 {
+		t.Error("wrong number of checks", f.calls)
+	}
+	ac.checkDue(now.Add(time.Hour))
+	if f.calls[slow.URL()] != 2 {
+		t.Error("slow alert should be due after an hour", f.calls)
+	}
+}
+
+func Test_scheduleInitialPending(t *testing.T) {
+	f := &CountingFetcher{body: "foo,1,2,60|1,1", calls: make(map[string]int)}
+	ac := newAlertsCollection(DummyEmailer{})
+	a := newAlert("foo", "foo", "", 10, "above", f, "test@example.com", "")
+	ac.addAlert(a)
+	if a.Status != "Pending" {
+		t.Error("a new alert should be pending")
+	}
+	now := time.Now()
+	ac.scheduleInitial(now)
+	for _, d := range ac.checkDue(now.Add(startupJitter)) {
+		_, rs, _, _, _ := d.UpdateState(0)
+		if rs != 0 {
+			t.Error("the first check shouldn't count as a recovery")
+		}
+	}
+	if a.Status != "OK" {
+		t.Error("expected the first check to have run", a.Status)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func Test_loadSecretFiles(t *testing.T) {
+	file := writeTempFile(t, "password", "hunter2\n")
+	os.Setenv("HOUND_SMTP_PASSWORD_FILE", file)
+	defer os.Unsetenv("HOUND_SMTP_PASSWORD_FILE")
+
+	c := config{SMTPUser: "hound"}
+	if err := loadSecretFiles("hound", &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.SMTPPassword != "hunter2" {
+		t.Errorf("expected the password from the file, got %q", c.SMTPPassword)
+	}
+
+	// the file overrides a password from the config file...
+	c = config{SMTPPassword: "from config"}
+	if err := loadSecretFiles("hound", &c); err != nil || c.SMTPPassword != "hunter2" {
+		t.Errorf("expected the password from the file, got %q, %v", c.SMTPPassword, err)
+	}
+
+	// ...but setting the variable as well is a mistake
+	os.Setenv("HOUND_SMTP_PASSWORD", "other")
+	defer os.Unsetenv("HOUND_SMTP_PASSWORD")
+	c = config{SMTPPassword: "other"}
+	if err := loadSecretFiles("hound", &c); err == nil {
+		t.Error("expected an error when both are set")
+	}
+}
+
+func Test_secretValues(t *testing.T) {
+	c := config{SMTPUser: "hound", SMTPPassword: "hunter2"}
+	if v := c.secretValues(); len(v) != 1 || v[0] != "hunter2" {
+		t.Errorf("expected just the password, got %v", v)
+	}
+}
+
+func Test_redactHook(t *testing.T) {
+	setSecrets([]string{"hunter2"})
+	defer setSecrets(nil)
+
+	e := log.WithFields(log.Fields{
+		"SMTP_PASSWORD": "anything",
+		"err":           errors.New("auth failed for hunter2"),
+		"url":           "http://user:pw@example.com/",
+		"count":         3,
+	})
+	e.Message = "password is hunter2"
+	if err := (redactHook{}).Fire(e); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range e.Data {
+		if s, ok := v.(string); ok && (strings.Contains(s, "hunter2") || strings.Contains(s, ":pw@")) {
+			t.Errorf("%s not redacted: %s", k, s)
+		}
+	}
+	if e.Data["SMTP_PASSWORD"] != redactedValue {
+		t.Errorf("expected the password field to be redacted, got %v", e.Data["SMTP_PASSWORD"])
+	}
+	if e.Data["count"] != 3 {
+		t.Error("other fields should be untouched")
+	}
+	if e.Message != "password is [REDACTED]" {
+		t.Errorf("unexpected message: %s", e.Message)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A metric can match more than one series (a wildcard, or a function
+// like groupByNode). Each series is judged on its own, and the alert
+// fails if any of them does, saying which.
+
+// graphiteSeries is one series from a graphite response, with NaN for
+// the datapoints graphite has nothing for.
+type graphiteSeries struct {
+	Name   string
+	Values []float64
+}
+
+// seriesReading is the latest value of one series, and the baseline
+// the evaluator compares it with.
+type seriesReading struct {
+	Name      string
+	Value     float64
+	Baseline  float64
+	Deviation float64
+	err       error
+}
+
+// seriesStatus is how one series of a multi-series alert did, for the
+// dashboard.
+type seriesStatus struct {
+	Name    string  `json:"name"`
+	Value   float64 `json:"value"`
+	Status  string  `json:"status"`
+	Message string  `json:"message,omitempty"`
+}
+
+// parseSeries reads either graphite's raw format, a line per series
+// ("name,start,end,step|v1,v2,None,..."), or its JSON format.
+func parseSeries(body string) ([]graphiteSeries, error) {
+	body = strings.Trim(body, "\n\t\r ")
+	if strings.HasPrefix(body, "[") {
+		return parseJSONSeries(body)
+	}
+	if body == "" {
+		return nil, errors.New("no series returned")
+	}
+	var series []graphiteSeries
+	for _, line := range strings.Split(body, "\n") {
+		s := graphiteSeries{}
+		if i := strings.Index(line, "|"); i >= 0 {
+			s.Name = rawSeriesName(line[:i])
+			line = line[i+1:]
+		}
+		for _, p := range strings.Split(line, ",") {
+			p = strings.TrimSpace(p)
+			if p == "None" {
+				s.Values = append(s.Values, math.NaN())
+				continue
+			}
+			v, err := strconv.ParseFloat(p, 64)
+			if err != nil {
+				return nil, err
+			}
+			s.Values = append(s.Values, v)
+		}
+		series = append(series, s)
+	}
+	return series, nil
+}
+
+// rawSeriesName takes the start, end and step off a raw header. The
+// name itself can have commas in it.
+func rawSeriesName(header string) string {
+	for i := 0; i < 3; i++ {
+		j := strings.LastIndex(header, ",")
+		if j < 0 {
+			break
+		}
+		header = header[:j]
+	}
+	return header
+}
+
+func parseJSONSeries(body string) ([]graphiteSeries, error) {
+	var data []struct {
+		Target     string       `json:"target"`
+		Datapoints [][]*float64 `json:"datapoints"`
+	}
+	if err := json.Unmarshal([]byte(body), &data); err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("no series returned")
+	}
+	series := make([]graphiteSeries, len(data))
+	for i, d := range data {
+		series[i].Name = d.Target
+		for _, p := range d.Datapoints {
+			if len(p) == 0 || p[0] == nil {
+				series[i].Values = append(series[i].Values, math.NaN())
+			} else {
+				series[i].Values = append(series[i].Values, *p[0])
+			}
+		}
+	}
+	return series, nil
+}
+
+// last is the most recent datapoint, which has to be there.
+func (s graphiteSeries) last() (float64, error) {
+	if len(s.Values) == 0 || math.IsNaN(s.Values[len(s.Values)-1]) {
+		return 0.0, errors.New("no recent value")
+	}
+	return s.Values[len(s.Values)-1], nil
+}
+
+// present is every datapoint that isn't missing.
+func (s graphiteSeries) present() []float64 {
+	var values []float64
+	for _, v := range s.Values {
+		if !math.IsNaN(v) {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// fetchSeries fetches url and parses every series out of it.
+func (a *alert) fetchSeries(url string) ([]graphiteSeries, error) {
+	s, err := a.fetchBody(url)
+	if err != nil {
+		return nil, err
+	}
+	series, err := parseSeries(s)
+	if err != nil {
+		a.Status = "Error"
+		a.Message = err.Error()
+	}
+	return series, err
+}
+
+// fetchReadings gets the latest value of every series the metric
+// matches, along with whatever baseline the evaluator needs.
+func (a *alert) fetchReadings() ([]seriesReading, error) {
+	switch a.Evaluator {
+	case "change", "stddev":
+		return a.fetchWindowBaseline()
+	case "weekly":
+		return a.fetchWeeklyBaseline()
+	}
+	series, err := a.fetchSeries(a.URL())
+	if err != nil {
+		return nil, err
+	}
+	readings := make([]seriesReading, len(series))
+	for i, s := range series {
+		readings[i].Name = s.Name
+		readings[i].Value, readings[i].err = s.last()
+	}
+	return readings, nil
+}
+
+// updateFromReadings sets the alert's status. A single series is judged
+// just as it always was; with more, each gets a status of its own.
+func (a *alert) updateFromReadings(readings []seriesReading) {
+	if len(readings) != 1 {
+		a.updateSeriesStatus(readings)
+		return
+	}
+	r := readings[0]
+	a.Series = nil
+	a.Baseline, a.Deviation = r.Baseline, r.Deviation
+	if r.err != nil {
+		a.Status = "Error"
+		a.Message = r.err.Error()
+		return
+	}
+	a.UpdateStatus(r.Value)
+}
+
+// updateSeriesStatus fails the alert if any series fails, or errors if
+// any errors and none fail. The value shown is the worst series'.
+func (a *alert) updateSeriesStatus(readings []seriesReading) {
+	series := make([]seriesStatus, len(readings))
+	var failed, errored []string
+	worst := -1
+	for i, r := range readings {
+		s := seriesStatus{Name: r.Name, Value: r.Value}
+		if r.err != nil {
+			s.Status, s.Message = "Error", r.err.Error()
+		} else {
+			probe := alert{Direction: a.Direction, Threshold: a.Threshold, Evaluator: a.Evaluator,
+				Baseline: r.Baseline, Deviation: r.Deviation}
+			probe.UpdateStatus(r.Value)
+			s.Status, s.Message = probe.Status, probe.Message
+			if worst < 0 || a.worseSeries(s, series[worst]) {
+				worst = i
+			}
+		}
+		series[i] = s
+		switch s.Status {
+		case "Failed":
+			failed = append(failed, fmt.Sprintf("%s: %s", s.Name, s.Message))
+		case "Error":
+			errored = append(errored, fmt.Sprintf("%s: %s", s.Name, s.Message))
+		}
+	}
+	a.Series = series
+	if worst >= 0 {
+		a.Value = readings[worst].Value
+		a.Baseline, a.Deviation = readings[worst].Baseline, readings[worst].Deviation
+	}
+	switch {
+	case len(failed) > 0:
+		a.Status = "Failed"
+		a.Message = fmt.Sprintf("%d of %d series failed: %s", len(failed), len(series), strings.Join(failed, "; "))
+	case len(errored) > 0:
+		a.Status = "Error"
+		a.Message = fmt.Sprintf("%d of %d series errored: %s", len(errored), len(series), strings.Join(errored, "; "))
+	default:
+		a.Status = "OK"
+		a.Message = ""
+	}
+}
+
+// worseSeries says whether s is a worse sign than t: failing beats
+// passing, then whichever is further in the alert's direction.
+func (a *alert) worseSeries(s, t seriesStatus) bool {
+	if (s.Status == "Failed") != (t.Status == "Failed") {
+		return s.Status == "Failed"
+	}
+	if a.Direction == "above" {
+		return s.Value > t.Value
+	}
+	return s.Value < t.Value
+}
+
+// FailingSeries names the series that aren't OK.
+func (a alert) FailingSeries() []string {
+	var names []string
+	for _, s := range a.Series {
+		if s.Status != "OK" {
+			names = append(names, s.Name)
+		}
+	}
+	return names
+}
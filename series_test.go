@@ -0,0 +1,102 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func Test_parseSeries(t *testing.T) {
+	series, err := parseSeries("sumSeries(a.b,a.c),1,2,60|1,2\nkeepLastValue(d),1,2,60|None,4\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 2 || series[0].Name != "sumSeries(a.b,a.c)" || series[1].Name != "keepLastValue(d)" {
+		t.Fatalf("wrong series: %+v", series)
+	}
+	if !math.IsNaN(series[1].Values[0]) || series[1].Values[1] != 4 {
+		t.Errorf("wrong values: %v", series[1].Values)
+	}
+
+	series, err = parseSeries(`[{"target": "a", "datapoints": [[1, 60], [null, 120]]},
+		{"target": "b", "datapoints": [[3, 60]]}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 2 || series[0].Name != "a" || series[1].Name != "b" {
+		t.Fatalf("wrong series: %+v", series)
+	}
+	if _, err := series[0].last(); err == nil {
+		t.Error("a null last datapoint should be an error")
+	}
+	if v, _ := series[1].last(); v != 3 {
+		t.Errorf("wrong value %f", v)
+	}
+	if _, err := parseSeries("[]"); err == nil {
+		t.Error("expected an error for no series")
+	}
+}
+
+func Test_CheckMetricMultipleSeries(t *testing.T) {
+	a := newAlert("foo", "app.*.failed", "", 1, "above", BodyFetcher{
+		"target=keepLastValue": "app.a.failed,1,2,60|0,0\napp.b.failed,1,2,60|0,3\napp.c.failed,1,2,60|0,None\napp.d.failed,1,2,60|0,2\n",
+	}, "test@example.com", "")
+	if a.CheckMetric() {
+		t.Error("should fail when any series fails")
+	}
+	if a.Status != "Failed" || a.Value != 3 {
+		t.Errorf("expected the worst series' value, got %s %f", a.Status, a.Value)
+	}
+	if !strings.HasPrefix(a.Message, "2 of 4 series failed: app.b.failed: ") ||
+		!strings.Contains(a.Message, "app.d.failed: ") {
+		t.Errorf("message should say which series failed: %s", a.Message)
+	}
+	if len(a.Series) != 4 || a.Series[0].Status != "OK" || a.Series[2].Status != "Error" {
+		t.Errorf("wrong series: %+v", a.Series)
+	}
+	failing := a.FailingSeries()
+	if len(failing) != 3 || failing[0] != "app.b.failed" {
+		t.Errorf("wrong failing series: %v", failing)
+	}
+
+	a.fetcher = BodyFetcher{"target=keepLastValue": "app.a.failed,1,2,60|0\napp.b.failed,1,2,60|None\n"}
+	a.CheckMetric()
+	if a.Status != "Error" || !strings.HasPrefix(a.Message, "1 of 2 series errored") {
+		t.Errorf("expected an error, got %s: %s", a.Status, a.Message)
+	}
+
+	a.fetcher = BodyFetcher{"target=keepLastValue": "app.a.failed,1,2,60|0\napp.b.failed,1,2,60|0.5\n"}
+	if !a.CheckMetric() || a.Message != "" || a.Value != 0.5 {
+		t.Errorf("expected OK, got %s: %s", a.Status, a.Message)
+	}
+
+	// back to one series, it's judged as a plain alert again
+	a.fetcher = BodyFetcher{"target=keepLastValue": "app.a.failed,1,2,60|2\n"}
+	a.CheckMetric()
+	if a.Status != "Failed" || a.Series != nil || strings.Contains(a.Message, "series") {
+		t.Errorf("single series should be judged on its own: %s %v", a.Message, a.Series)
+	}
+}
+
+func Test_CheckMetricWeeklyMultipleSeries(t *testing.T) {
+	a := newAlert("foo", "foo.*", "", 50, "below", BodyFetcher{
+		"timeShift":         "a,1,2,60|100\nb,1,2,60|100\n",
+		"keepLastValue(foo": "a,1,2,60|90\nb,1,2,60|20\n",
+	}, "test@example.com", "")
+	a.Evaluator = "weekly"
+	if a.CheckMetric() {
+		t.Error("an 80% drop in one series should fail")
+	}
+	if a.Series[0].Status != "OK" || a.Series[1].Status != "Failed" || a.Value != 20 || a.Baseline != 100 {
+		t.Errorf("wrong series: %+v", a.Series)
+	}
+
+	a.fetcher = BodyFetcher{
+		"timeShift":         "a,1,2,60|100\n",
+		"keepLastValue(foo": "a,1,2,60|90\nb,1,2,60|20\n",
+	}
+	a.CheckMetric()
+	if a.Status != "Error" {
+		t.Error("different numbers of series should be an error")
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	log "github.com/sirupsen/logrus"
+)
+
+// Settings come from the "Settings" section of the config file, named
+// like the fields of config (eg, "SMTPServer"), with HOUND_* variables
+// overriding them. They're read again on SIGHUP and most take effect
+// straight away; the ones tagged `restart:"true"` belong to state that
+// lives as long as the process, and only change on a restart.
+
+// loadSettings works out the settings from the config file and the
+// environment.
+func loadSettings(f configData) (config, error) {
+	var c config
+	if f.Settings != nil {
+		c = *f.Settings
+	}
+	if err := envconfig.Process("hound", &c); err != nil {
+		return c, err
+	}
+	if err := loadSecretFiles("hound", &c); err != nil {
+		return c, err
+	}
+	c.setDefaults()
+	return c, nil
+}
+
+func (c *config) setDefaults() {
+	if c.ReadTimeout == 0 {
+		c.ReadTimeout = 5
+	}
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = 10
+	}
+	if c.Window == "" {
+		c.Window = "10mins"
+	}
+	if c.ExpandInterval == 0 {
+		c.ExpandInterval = int(defaultExpandInterval / time.Minute)
+	}
+	if c.WatchPollInterval == 0 {
+		c.WatchPollInterval = 10
+	}
+}
+
+// changedSettings names the settings that differ between old and c.
+func (c config) changedSettings(old config) []string {
+	var changed []string
+	v, o := reflect.ValueOf(c), reflect.ValueOf(old)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if !reflect.DeepEqual(v.Field(i).Interface(), o.Field(i).Interface()) {
+			changed = append(changed, t.Field(i).Name)
+		}
+	}
+	return changed
+}
+
+// reloaded is c with the settings that need a restart put back as they
+// were in old, logging what changed either way.
+func (c config) reloaded(old config) config {
+	v, o := reflect.ValueOf(&c).Elem(), reflect.ValueOf(old)
+	for _, name := range c.changedSettings(old) {
+		field, _ := v.Type().FieldByName(name)
+		if field.Tag.Get("restart") == "true" {
+			v.FieldByName(name).Set(o.FieldByName(name))
+			log.WithFields(log.Fields{"setting": name}).Warn("setting only changes on restart")
+			continue
+		}
+		log.WithFields(log.Fields{"setting": name}).Info("setting changed")
+	}
+	return c
+}
+
+// applySettings puts c into effect. Everything is checked before
+// anything is changed, so a bad setting leaves the old ones running.
+func applySettings(c config) error {
+	apply, err := prepareSettings(c)
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// prepareSettings checks c, returning a function that puts it into
+// effect.
+func prepareSettings(c config) (func(), error) {
+	transport, err := newSMTPTransport(c)
+	if err != nil {
+		return nil, err
+	}
+	var report *reportConfig
+	if c.ReportSchedule != "" {
+		schedule, err := parseReportSchedule(c.ReportSchedule)
+		if err != nil {
+			return nil, err
+		}
+		reportTo := c.ReportTo
+		if reportTo == "" {
+			reportTo = c.EmailTo
+		}
+		report = &reportConfig{Schedule: schedule, To: reportTo}
+	}
+	templates, err := c.notificationTemplates()
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		c.apply(transport, report, templates)
+	}, nil
+}
+
+// notificationTemplates are the templates c puts in effect for every
+// alert.
+func (c config) notificationTemplates() (*template.Template, error) {
+	if c.NotificationTemplates == "" {
+		return baseNotificationTemplates, nil
+	}
+	t, err := loadNotificationTemplates(baseNotificationTemplates, c.NotificationTemplates)
+	if err == nil {
+		err = validateNotificationTemplates(t)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", c.NotificationTemplates, err)
+	}
+	return t, nil
+}
+
+// finder asks the graphite c names which series match a wildcard.
+func (c config) finder() graphiteFinder {
+	base := c.GraphiteFindURL
+	if base == "" {
+		base = defaultFindBase(c.GraphiteBase)
+	}
+	return graphiteFinder{base: base, fetcher: httpFetcher{
+		auth: &basicAuth{c.GraphiteBasicAuthUser, c.GraphiteBasicAuthPassword}}}
+}
+
+// settingsMu is held while the settings change. The alerts and the web
+// UI are stopped by then, but the outbox carries on sending, so it reads
+// the settings it needs under settingsMu.
+var settingsMu sync.RWMutex
+
+func (c config) apply(transport smtpTransport, report *reportConfig, templates *template.Template) {
+	settingsMu.Lock()
+	setSecrets(c.secretValues())
+	setLogLevel(c.LogLevel)
+	graphiteBase = c.GraphiteBase
+	graphiteBasicAuthUser = c.GraphiteBasicAuthUser
+	graphiteBasicAuthPassword = c.GraphiteBasicAuthPassword
+	carbonBase = c.CarbonBase
+	metricBase = c.MetricBase
+	emailFrom = c.EmailFrom
+	emailTo = c.EmailTo
+	checkInterval = c.CheckInterval
+	globalThrottle = c.GlobalThrottle
+	emailOnError = c.EmailOnError
+	window = c.Window
+	mailTransport = transport
+	reportSettings = report
+	notificationTemplates = templates
+	emailTemplate = loadEmailTemplate(c)
+	dashboardURL = c.DashboardURL
+	settingsMu.Unlock()
+	// this can send mail, so it has to wait until the lock's released
+	applyDigestSettings(c)
+}
+
+// applyDigestSettings keeps whatever the digest has collected when its
+// window changes, and sends it on if digest mode is turned off.
+func applyDigestSettings(c config) {
+	w := time.Duration(c.DigestWindow) * time.Minute
+	switch {
+	case c.Digest && digest == nil:
+		digest = newDigestCollector(w)
+	case c.Digest:
+		digest.SetWindow(w)
+	case digest != nil:
+		digest.SetWindow(0)
+		for _, m := range digest.Flush(time.Now()) {
+			queueMail(m)
+		}
+		digest = nil
+	}
+}
+
+// setLogLevel defaults to INFO.
+func setLogLevel(level string) {
+	switch level {
+	case "DEBUG":
+		log.SetLevel(log.DebugLevel)
+	case "WARN":
+		log.SetLevel(log.WarnLevel)
+	case "ERROR":
+		log.SetLevel(log.ErrorLevel)
+	case "FATAL":
+		log.SetLevel(log.FatalLevel)
+	default:
+		log.SetLevel(log.InfoLevel)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func Test_loadSettings(t *testing.T) {
+	os.Setenv("HOUND_GLOBAL_THROTTLE", "7")
+	defer os.Unsetenv("HOUND_GLOBAL_THROTTLE")
+	f, err := readConfig(writeConfigFiles(t, map[string]string{"hound.yaml": `
+Settings:
+  GraphiteBase: https://graphite.example.com/render/
+  GlobalThrottle: 3
+  CheckInterval: 2
+`}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadSettings(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.GraphiteBase != "https://graphite.example.com/render/" || c.CheckInterval != 2 {
+		t.Errorf("settings from the file not used: %+v", c)
+	}
+	if c.GlobalThrottle != 7 {
+		t.Errorf("the environment should override the file, got %d", c.GlobalThrottle)
+	}
+	if c.Window != "10mins" || c.ReadTimeout != 5 {
+		t.Errorf("defaults not filled in: %+v", c)
+	}
+}
+
+func Test_reloadedSettings(t *testing.T) {
+	old := config{CheckInterval: 1, QueueFile: "a.json", SMTPPassword: "x"}
+	c := config{CheckInterval: 5, QueueFile: "b.json", SMTPPassword: "x"}
+	changed := c.changedSettings(old)
+	if strings.Join(changed, ",") != "CheckInterval,QueueFile" {
+		t.Errorf("wrong changes: %v", changed)
+	}
+	c = c.reloaded(old)
+	if c.CheckInterval != 5 || c.QueueFile != "a.json" {
+		t.Errorf("restart-only settings should be kept: %+v", c)
+	}
+}
+
+func Test_applySettingsWhileSending(t *testing.T) {
+	savedTransport := mailTransport
+	defer func() { mailTransport = savedTransport }()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			// nothing's listening, so this only reads the transport
+			sendMail(mailMessage{To: "ops@example.com", Subject: "test"})
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if err := applySettings(config{SMTPServer: "127.0.0.1", SMTPPort: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
+
+func Test_applySettings(t *testing.T) {
+	savedTransport, savedLevel := mailTransport, log.GetLevel()
+	defer func() {
+		applySettings(config{})
+		mailTransport = savedTransport
+		log.SetLevel(savedLevel)
+	}()
+
+	if err := applySettings(config{GraphiteBase: "https://graphite.example.com/render/",
+		Window: "5mins", GlobalThrottle: 4, ReportSchedule: "daily 08:00", EmailTo: "ops@example.com",
+		Digest: true, DigestWindow: 10, LogLevel: "WARN"}); err != nil {
+		t.Fatal(err)
+	}
+	if graphiteBase != "https://graphite.example.com/render/" || window != "5mins" || globalThrottle != 4 {
+		t.Errorf("globals not set: %s %s %d", graphiteBase, window, globalThrottle)
+	}
+	if g := (config{GraphiteBase: "https://graphite.example.com/render/"}).finder(); g.base != "https://graphite.example.com/metrics/find/" {
+		t.Errorf("find URL not worked out: %s", g.base)
+	}
+	if reportSettings == nil || reportSettings.To != "ops@example.com" || log.GetLevel() != log.WarnLevel {
+		t.Error("report or log level not set")
+	}
+	if digest == nil || digest.window != 10*time.Minute {
+		t.Fatal("digest not set up")
+	}
+	d := digest
+	d.Add([]string{"ops@example.com"}, digestEntry{Kind: "alert", Name: "x", Time: time.Now()})
+
+	// a bad setting changes nothing
+	if err := applySettings(config{Window: "1mins", ReportSchedule: "sometimes"}); err == nil {
+		t.Error("expected an error for a bad report schedule")
+	}
+	if window != "5mins" || reportSettings == nil {
+		t.Error("settings changed despite the error")
+	}
+
+	// changing the window keeps what's been collected
+	if err := applySettings(config{Digest: true, DigestWindow: 30}); err != nil {
+		t.Fatal(err)
+	}
+	if digest != d || d.window != 30*time.Minute || len(d.pending) != 1 {
+		t.Error("digest should be kept with its new window")
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// smtpTransport is how Hound talks to its mail server.
+//
+// TLSMode is one of:
+//
+//	"none"     plain SMTP
+//	"starttls" plain SMTP upgraded with STARTTLS, failing if the server
+//	           doesn't offer it (eg, port 587)
+//	"tls"      TLS from the start (eg, port 465)
+//
+// Left empty, port 25 means plain SMTP that still upgrades if the server
+// offers STARTTLS, and any other port means "tls", which is how Hound
+// always behaved.
+//
+// AuthMechanism is "plain", "login", "cram-md5" or "none"; it defaults
+// to "plain" when a user is configured.
+type smtpTransport struct {
+	Server        string
+	Port          int
+	User          string
+	Password      string
+	TLSMode       string
+	TLSConfig     *tls.Config
+	AuthMechanism string
+	Timeout       time.Duration
+}
+
+var mailTransport smtpTransport
+
+func newSMTPTransport(c config) (smtpTransport, error) {
+	t := smtpTransport{
+		Server:        c.SMTPServer,
+		Port:          c.SMTPPort,
+		User:          c.SMTPUser,
+		Password:      c.SMTPPassword,
+		TLSMode:       strings.ToLower(c.SMTPTLSMode),
+		AuthMechanism: strings.ToLower(c.SMTPAuth),
+		Timeout:       time.Duration(c.SMTPTimeout) * time.Second,
+	}
+	switch t.TLSMode {
+	case "", "none", "starttls", "tls":
+	default:
+		return t, fmt.Errorf("unknown SMTP TLS mode %q", c.SMTPTLSMode)
+	}
+	switch t.AuthMechanism {
+	case "":
+		t.AuthMechanism = "none"
+		if t.User != "" {
+			t.AuthMechanism = "plain"
+		}
+	case "none", "plain", "login", "cram-md5":
+	default:
+		return t, fmt.Errorf("unknown SMTP auth mechanism %q", c.SMTPAuth)
+	}
+	if t.Timeout == 0 {
+		t.Timeout = 30 * time.Second
+	}
+
+	serverName := c.SMTPServerName
+	if serverName == "" {
+		serverName = c.SMTPServer
+	}
+	t.TLSConfig = &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: c.SMTPInsecureSkipVerify,
+	}
+	if c.SMTPCAFile != "" {
+		pem, err := ioutil.ReadFile(c.SMTPCAFile)
+		if err != nil {
+			return t, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return t, fmt.Errorf("no certificates found in %s", c.SMTPCAFile)
+		}
+		t.TLSConfig.RootCAs = pool
+	}
+	if c.SMTPClientCert != "" || c.SMTPClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(c.SMTPClientCert, c.SMTPClientKey)
+		if err != nil {
+			return t, err
+		}
+		t.TLSConfig.Certificates = []tls.Certificate{cert}
+	}
+	return t, nil
+}
+
+func (t smtpTransport) address() string {
+	return net.JoinHostPort(t.Server, fmt.Sprintf("%d", t.Port))
+}
+
+func (t smtpTransport) mode() string {
+	if t.TLSMode != "" {
+		return t.TLSMode
+	}
+	if t.Port == 25 {
+		return ""
+	}
+	return "tls"
+}
+
+func (t smtpTransport) auth() smtp.Auth {
+	switch t.AuthMechanism {
+	case "plain":
+		return smtp.PlainAuth("", t.User, t.Password, t.Server)
+	case "login":
+		return &loginAuth{username: t.User, password: t.Password, host: t.Server}
+	case "cram-md5":
+		return smtp.CRAMMD5Auth(t.User, t.Password)
+	}
+	return nil
+}
+
+// Dial connects, sets up TLS and authenticates. The whole conversation
+// has to finish within Timeout.
+func (t smtpTransport) Dial() (*smtp.Client, error) {
+	dialer := &net.Dialer{Timeout: t.Timeout}
+	var conn net.Conn
+	var err error
+	if t.mode() == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", t.address(), t.TLSConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", t.address())
+	}
+	if err != nil {
+		log.WithFields(
+			log.Fields{
+				"error":       err,
+				"mail server": t.address(),
+			},
+		).Error("error connecting to mail server")
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(t.Timeout))
+
+	c, err := smtp.NewClient(conn, t.Server)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("smtp.NewClient failed")
+		conn.Close()
+		return nil, err
+	}
+
+	if t.mode() == "starttls" || t.mode() == "" {
+		ok, _ := c.Extension("STARTTLS")
+		if !ok && t.mode() == "starttls" {
+			c.Close()
+			return nil, errors.New("mail server doesn't support STARTTLS")
+		}
+		if ok {
+			if err = c.StartTLS(t.TLSConfig); err != nil {
+				log.WithFields(log.Fields{"err": err}).Error("STARTTLS failed")
+				c.Close()
+				return nil, err
+			}
+		}
+	}
+
+	if auth := t.auth(); auth != nil {
+		if err = c.Auth(auth); err != nil {
+			log.WithFields(
+				log.Fields{
+					"err":         err,
+					"SMTP_USER":   t.User,
+					"SMTP_SERVER": t.Server,
+				}).Error("auth failed")
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// loginAuth implements the LOGIN mechanism, which net/smtp doesn't
+// provide but plenty of servers (Exchange, Office 365) still want.
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// same rule as smtp.PlainAuth: never send credentials in the clear
+	// to anything but localhost
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge %q", fromServer)
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// selfSignedCert makes a certificate for 127.0.0.1 and returns it along
+// with its PEM encoding, for use as a CA file.
+func selfSignedCert(t *testing.T) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "hound test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:              []string{"mail.example.com"},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, string(certPEM)
+}
+
+func testConfig(s *fakeSMTPServer) config {
+	host, port, _ := net.SplitHostPort(s.Addr())
+	p, _ := strconv.Atoi(port)
+	return config{SMTPServer: host, SMTPPort: p, SMTPTimeout: 5}
+}
+
+func sendTestMessage(t *testing.T, c config) error {
+	tr, err := newSMTPTransport(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := tr.Dial()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return deliver(client, mailMessage{From: "hound@example.com", To: "ops@example.com", Subject: "test", Text: "hi"})
+}
+
+func Test_newSMTPTransportValidation(t *testing.T) {
+	if _, err := newSMTPTransport(config{SMTPTLSMode: "ssl"}); err == nil {
+		t.Error("expected an error for an unknown TLS mode")
+	}
+	if _, err := newSMTPTransport(config{SMTPAuth: "ntlm"}); err == nil {
+		t.Error("expected an error for an unknown auth mechanism")
+	}
+	if _, err := newSMTPTransport(config{SMTPCAFile: writeTempFile(t, "ca.pem", "not a cert")}); err == nil {
+		t.Error("expected an error for a CA file without certificates")
+	}
+
+	tr, err := newSMTPTransport(config{SMTPServer: "mail", SMTPUser: "hound"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.AuthMechanism != "plain" || tr.Timeout != 30*time.Second {
+		t.Errorf("unexpected defaults: %q %v", tr.AuthMechanism, tr.Timeout)
+	}
+	if tr.TLSConfig.InsecureSkipVerify {
+		t.Error("certificates should be verified by default")
+	}
+	if (smtpTransport{Port: 25}).mode() != "" || (smtpTransport{Port: 465}).mode() != "tls" {
+		t.Error("unexpected default TLS modes")
+	}
+}
+
+func Test_smtpTransportStartTLS(t *testing.T) {
+	cert, caPEM := selfSignedCert(t)
+	s := newFakeSMTPServer(t)
+	s.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	s.auth = true
+
+	c := testConfig(s)
+	c.SMTPTLSMode = "starttls"
+	if err := sendTestMessage(t, c); err == nil {
+		t.Error("expected the unknown certificate to be refused")
+	}
+
+	c.SMTPCAFile = writeTempFile(t, "ca.pem", caPEM)
+	c.SMTPUser = "hound"
+	c.SMTPPassword = "secret"
+	c.SMTPAuth = "login"
+	if err := sendTestMessage(t, c); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.messages) != 1 {
+		t.Fatalf("expected one message, got %d", len(s.messages))
+	}
+	if len(s.authed) != 1 || s.authed[0] != "LOGIN hound secret" {
+		t.Errorf("unexpected auth: %v", s.authed)
+	}
+}
+
+func Test_smtpTransportImplicitTLS(t *testing.T) {
+	cert, _ := selfSignedCert(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTPServer{ln: ln, auth: true}
+	go s.serve()
+	t.Cleanup(func() { ln.Close() })
+
+	c := testConfig(s)
+	c.SMTPTLSMode = "tls"
+	c.SMTPServerName = "mail.example.com"
+	c.SMTPInsecureSkipVerify = true
+	c.SMTPUser = "hound"
+	c.SMTPPassword = "secret"
+	if err := sendTestMessage(t, c); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.authed) != 1 || s.authed[0] != "PLAIN hound secret" {
+		t.Errorf("unexpected auth: %v", s.authed)
+	}
+}
+
+func Test_smtpTransportStartTLSRequired(t *testing.T) {
+	s := newFakeSMTPServer(t)
+	c := testConfig(s)
+	c.SMTPTLSMode = "starttls"
+	err := sendTestMessage(t, c)
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Errorf("expected a STARTTLS error, got %v", err)
+	}
+	if len(s.messages) != 0 {
+		t.Error("nothing should have been sent")
+	}
+
+	// plain SMTP is still available when asked for explicitly
+	c.SMTPTLSMode = "none"
+	if err := sendTestMessage(t, c); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+// The Run loop is the only thing that touches the live alerts. At the
+// end of every cycle it publishes a snapshot: copies of every alert,
+// linked to each other rather than to the live ones, which are never
+// modified afterwards. The HTTP handlers only ever read snapshots, so
+// they see a consistent view without holding up the checks.
+
+type alertsSnapshot struct {
+	alerts []*alert
+	byHash map[string]*alert
+}
+
+func (ac *alertsCollection) takeSnapshot() alertsSnapshot {
+	copies := make(map[*alert]*alert, len(ac.alerts))
+	snap := alertsSnapshot{byHash: make(map[string]*alert, len(ac.alerts))}
+	for _, a := range ac.alerts {
+		c := *a
+		// Format floats to four decimal places for display.
+		c.Value = roundToFourPlaces(c.Value)
+		c.Pages = append([]pageRecord(nil), a.Pages...)
+		c.Series = append([]seriesStatus(nil), a.Series...)
+		for i := range c.Series {
+			c.Series[i].Value = roundToFourPlaces(c.Series[i].Value)
+		}
+		copies[a] = &c
+		snap.alerts = append(snap.alerts, &c)
+	}
+	for _, c := range snap.alerts {
+		c.Children = relink(c.Children, copies)
+		c.Parents = relink(c.Parents, copies)
+	}
+	for h, a := range ac.alertsByHash {
+		snap.byHash[h] = copies[a]
+	}
+	return snap
+}
+
+func relink(alerts []*alert, copies map[*alert]*alert) []*alert {
+	if alerts == nil {
+		return nil
+	}
+	linked := make([]*alert, len(alerts))
+	for i, a := range alerts {
+		linked[i] = copies[a]
+	}
+	return linked
+}
+
+// publish makes the current state of the alerts visible to readers.
+func (ac *alertsCollection) publish() {
+	snap := ac.takeSnapshot()
+	ac.mu.Lock()
+	ac.snapshot = snap
+	ac.mu.Unlock()
+}
+
+func (ac *alertsCollection) currentSnapshot() alertsSnapshot {
+	ac.mu.RLock()
+	defer ac.mu.RUnlock()
+	return ac.snapshot
+}
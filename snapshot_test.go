@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_takeSnapshot(t *testing.T) {
+	ac := newAlertsCollection(DummyEmailer{})
+	parent := newAlert("parent", "parent", "", 10, "above", DummyFetcher{}, "test@example.com", "")
+	child := newAlert("child", "child", "", 10, "above", DummyFetcher{}, "test@example.com", "")
+	ac.addAlert(parent)
+	ac.addAlert(child)
+	ac.linkDependencies(child, alertData{Name: "child", DependsOn: []string{"parent"}})
+	child.Value = 1.23456789
+
+	ac.publish()
+	snap := ac.currentSnapshot()
+	if len(snap.alerts) != 2 || snap.alerts[1] == child {
+		t.Fatal("snapshot should hold copies of the alerts")
+	}
+	if snap.alerts[1].Parents[0] != snap.alerts[0] {
+		t.Error("snapshot parents should point at other snapshot alerts")
+	}
+	if snap.alerts[1].Value != 1.2346 || child.Value != 1.23456789 {
+		t.Error("only the snapshot value should be rounded")
+	}
+	if snap.byHash[child.Hash()] != snap.alerts[1] {
+		t.Error("snapshot lookup by hash failed")
+	}
+
+	child.Status = "Failed"
+	if ac.currentSnapshot().alerts[1].Status == "Failed" {
+		t.Error("snapshot changed before it was republished")
+	}
+}
+
+// run with -race to catch unsynchronized access between the check loop
+// and the HTTP handlers
+func Test_concurrentPageResponses(t *testing.T) {
+	f := &CountingFetcher{body: "foo,1,2,60|1,20", calls: make(map[string]int)}
+	ac := newAlertsCollection(DummyEmailer{})
+	for _, name := range []string{"one", "two", "three"} {
+		a := newAlert(name, name, "", 10, "above", f, "test@example.com", "")
+		ac.addAlert(a)
+	}
+	ac.linkDependencies(ac.alerts[1], alertData{Name: "two", DependsOn: []string{"one"}})
+	ac.publish()
+	h := ac.alerts[0].Hash()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			for _, a := range ac.alerts {
+				a.NextCheck = time.Time{}
+			}
+			ac.processAll()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		pr := ac.MakePageResponse()
+		for _, a := range pr.Alerts {
+			_ = a.String()
+			_ = a.RootCause()
+		}
+		ac.MakeindivPageResponse(h, "")
+	}
+	wg.Wait()
+
+	if ac.MakePageResponse().Alerts[0].Status != "Failed" {
+		t.Error("expected the last cycle to have been published")
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Every notification about one incident (from an alert first failing
+// until it recovers) gets a Message-ID derived from the alert's hash and
+// when the incident started, and refers back to the first one, so mail
+// clients thread the repeats and the recovery together.
+
+// startIncidentIfNeeded notes when an alert goes from healthy (or not
+// yet checked) to failing or erroring.
+func (a *alert) startIncidentIfNeeded(now time.Time) {
+	if !a.down() || a.JustRecovered() {
+		return
+	}
+	a.IncidentStart = now
+	a.incidentMessages = 0
+	a.openIncident(now)
+}
+
+func (a alert) incidentMessageID(suffix string) string {
+	domain := mailMessage{From: emailFrom}.domain()
+	id := fmt.Sprintf("hound.%s.%d", a.Hash(), a.IncidentStart.Unix())
+	if suffix != "" {
+		id += "." + suffix
+	}
+	return "<" + id + "@" + domain + ">"
+}
+
+func (a *alert) threadAlert(m *mailMessage) {
+	root := a.incidentMessageID("")
+	if a.incidentMessages == 0 {
+		m.MessageID = root
+	} else {
+		m.MessageID = a.incidentMessageID(fmt.Sprintf("%d", a.incidentMessages))
+		m.InReplyTo = a.lastIncidentMessageID()
+		m.References = root
+		if m.InReplyTo != root {
+			m.References += " " + m.InReplyTo
+		}
+	}
+	a.incidentMessages++
+}
+
+func (a *alert) threadRecovery(m *mailMessage) {
+	root := a.incidentMessageID("")
+	m.MessageID = a.incidentMessageID("recovered")
+	m.InReplyTo = a.lastIncidentMessageID()
+	m.References = root
+	if m.InReplyTo != root {
+		m.References += " " + m.InReplyTo
+	}
+}
+
+// lastIncidentMessageID is the most recent alert email about the current
+// incident, or where the first one would have been if none went out.
+func (a alert) lastIncidentMessageID() string {
+	if a.incidentMessages <= 1 {
+		return a.incidentMessageID("")
+	}
+	return a.incidentMessageID(fmt.Sprintf("%d", a.incidentMessages-1))
+}
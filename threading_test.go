@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_incidentThreading(t *testing.T) {
+	emailFrom = "hound@example.com"
+	defer func() { emailFrom = "" }()
+
+	a := newAlert("foo", "foo", "", 10, "above", DummyFetcher{}, "test@example.com", "")
+	a.PreviousStatus = "OK"
+	a.Status = "Failed"
+	start := time.Unix(1600000000, 0)
+	a.startIncidentIfNeeded(start)
+	if !a.IncidentStart.Equal(start) {
+		t.Fatal("incident should have started")
+	}
+
+	var first, second, third mailMessage
+	a.threadAlert(&first)
+	a.threadAlert(&second)
+	a.threadAlert(&third)
+	root := "<hound." + a.Hash() + ".1600000000@example.com>"
+	if first.MessageID != root || first.InReplyTo != "" {
+		t.Error("first message should be the root of the thread", first.MessageID)
+	}
+	if second.InReplyTo != root || second.References != root {
+		t.Error("second message should reply to the root", second.InReplyTo, second.References)
+	}
+	if third.InReplyTo != second.MessageID || third.References != root+" "+second.MessageID {
+		t.Error("third message should reply to the second", third.InReplyTo, third.References)
+	}
+
+	// still the same incident on the next cycle
+	a.PreviousStatus = "Failed"
+	a.startIncidentIfNeeded(start.Add(time.Hour))
+	if !a.IncidentStart.Equal(start) {
+		t.Error("a continuing failure shouldn't start a new incident")
+	}
+
+	var recovery mailMessage
+	a.threadRecovery(&recovery)
+	if !strings.HasSuffix(recovery.MessageID, ".recovered@example.com>") {
+		t.Error("wrong recovery id", recovery.MessageID)
+	}
+	if recovery.InReplyTo != third.MessageID || !strings.HasPrefix(recovery.References, root) {
+		t.Error("recovery should thread onto the incident", recovery.InReplyTo, recovery.References)
+	}
+}
+
+func Test_threadingHeaders(t *testing.T) {
+	m := mailMessage{From: "hound@example.com", To: "test@example.com", MessageID: "<b@example.com>",
+		InReplyTo: "<a@example.com>", References: "<a@example.com>"}
+	raw := string(m.Bytes())
+	for _, h := range []string{"Message-ID: <b@example.com>\r\n", "In-Reply-To: <a@example.com>\r\n", "References: <a@example.com>\r\n"} {
+		if !strings.Contains(raw, h) {
+			t.Error("missing header", h)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// webhookError is a webhook answering with something other than 2xx.
+type webhookError struct {
+	StatusCode int
+}
+
+func (e webhookError) Error() string {
+	return fmt.Sprintf("webhook returned %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// permanent is true for a 4xx, except the ones that mean "not now".
+func (e webhookError) permanent() bool {
+	return e.StatusCode >= 400 && e.StatusCode < 500 &&
+		e.StatusCode != http.StatusRequestTimeout && e.StatusCode != http.StatusTooManyRequests
+}
+
+type webhookPayload struct {
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+}
+
+// postWebhook posts the subject and text of m as JSON. Chat services'
+// incoming webhooks (Slack, Mattermost) show the "text".
+func postWebhook(url string, m mailMessage) error {
+	body, err := json.Marshal(webhookPayload{Subject: m.Subject, Text: m.Subject + "\n\n" + m.Text})
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: time.Second * 10}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.WithFields(log.Fields{"error": fmt.Sprintf("%v", err)}).Error("webhook failed")
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return webhookError{StatusCode: resp.StatusCode}
+	}
+	return nil
+}